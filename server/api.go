@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// ---- HTTP API ----
+//
+// Routes are served under /plugins/com.mattermost.songlink.
+
+const maxRequestBodyBytes = 1 << 20
+
+func (p *Plugin) initRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/post-action", p.requireUser(p.handlePostAction))
+	mux.HandleFunc("POST /api/v1/dialog", p.requireUser(p.handleDialogSubmit))
+	mux.HandleFunc("POST /api/v1/share", p.requireUser(p.handleShare))
+	mux.HandleFunc("POST /api/v1/remove", p.requireUser(p.handleRemove))
+	mux.HandleFunc("POST /api/v1/open", p.requireUser(p.handleOpen))
+	mux.HandleFunc("GET /api/v1/resolve", p.requireUser(p.handleResolve))
+	mux.HandleFunc("GET /api/v1/health", p.handleHealth)
+	mux.HandleFunc("GET /api/v1/metrics", p.handleMetrics)
+	return mux
+}
+
+func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	if p.router == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p.router.ServeHTTP(w, r)
+}
+
+// requireUser rejects requests that don't come from a logged-in user.
+// Mattermost sets Mattermost-User-Id only after authenticating the session.
+func (p *Plugin) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Mattermost-User-Id") == "" {
+			writeError(w, http.StatusUnauthorized, "not authorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handlePostAction backs the "Create music preview" post menu item.
+func (p *Plugin) handlePostAction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+
+	var req struct {
+		PostID string `json:"post_id"`
+		TeamID string `json:"team_id"` // the user's current team, for posts in DMs
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyBytes)).Decode(&req); err != nil || !model.IsValidId(req.PostID) {
+		writeError(w, http.StatusBadRequest, "missing or invalid post_id")
+		return
+	}
+
+	post, appErr := p.API.GetPost(req.PostID)
+	if appErr != nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	if !p.API.HasPermissionToChannel(userID, post.ChannelId, model.PermissionReadChannelContent) {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	locale := p.userLocale(userID)
+	musicURL := p.firstMusicURL(post.Message)
+	if musicURL == "" {
+		p.API.SendEphemeralPost(userID, &model.Post{
+			ChannelId: post.ChannelId,
+			RootId:    post.RootId,
+			Message:   tr(locale, "no_music_link"),
+		})
+		writeJSON(w, http.StatusOK, map[string]string{"status": "no_music_url"})
+		return
+	}
+
+	if refusal := p.previewRefusal(userID, p.actionTeam(post.ChannelId, userID, req.TeamID)); refusal != "" {
+		p.API.SendEphemeralPost(userID, &model.Post{
+			ChannelId: post.ChannelId,
+			RootId:    post.RootId,
+			Message:   tr(locale, refusal),
+		})
+		writeJSON(w, http.StatusOK, map[string]string{"status": refusal})
+		return
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+	ok := p.submit(func() {
+		att, track, err := p.lookupOdesli(musicURL, p.config().country())
+		if err != nil || att == nil {
+			p.API.SendEphemeralPost(userID, &model.Post{
+				ChannelId: post.ChannelId,
+				RootId:    rootID,
+				Message:   tr(locale, "lookup_failed"),
+			})
+			if err != nil {
+				p.API.LogError("odesli lookup failed", "err", err.Error())
+			}
+			return
+		}
+		// Attributed to whoever asked: in DMs and GMs the preview may be
+		// posted as them, never as the post's author.
+		if err := p.postUnfurl(post.ChannelId, rootID, userID, att, track); err != nil {
+			p.API.SendEphemeralPost(userID, &model.Post{
+				ChannelId: post.ChannelId,
+				RootId:    rootID,
+				Message:   tr(locale, "post_failed"),
+			})
+			p.logWarn("failed to create unfurl post", "err", err.Error())
+		}
+	})
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "busy, try again")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "ok"})
+}
+
+// actionTeam is the team a post menu action counts against: the channel's,
+// or for DMs and GMs the current team the client sent, if userID is in it.
+func (p *Plugin) actionTeam(channelID, userID, clientTeamID string) string {
+	if ch, appErr := p.API.GetChannel(channelID); appErr == nil && ch.TeamId != "" {
+		return ch.TeamId
+	}
+	if !model.IsValidId(clientTeamID) {
+		return ""
+	}
+	if _, appErr := p.API.GetTeamMember(clientTeamID, userID); appErr != nil {
+		return ""
+	}
+	return clientTeamID
+}
+
+// resolvedTrack is the /api/v1/resolve response.
+type resolvedTrack struct {
+	Title     string            `json:"title"`
+	Artist    string            `json:"artist,omitempty"`
+	Thumbnail string            `json:"thumbnail,omitempty"`
+	PageURL   string            `json:"page_url"`
+	Links     map[string]string `json:"links"` // Odesli platform key → URL
+}
+
+// handleResolve lets other plugins resolve a music link through our cache
+// and Odesli client.
+func (p *Plugin) handleResolve(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("url"))
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "missing url")
+		return
+	}
+	musicURL := cleanMusicURL(raw)
+	if !p.config().isMusicURL(musicURL) {
+		writeError(w, http.StatusBadRequest, "not a music link")
+		return
+	}
+
+	country := p.config().country()
+	if c := r.URL.Query().Get("country"); c != "" {
+		code, ok := normalizeCountry(c)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "country must be a two-letter code")
+			return
+		}
+		country = code
+	}
+
+	ctx, cancel := p.lookupContext()
+	defer cancel()
+	o, err := p.resolve(ctx, musicURL, country)
+	if errors.Is(err, errLookupTimeout) {
+		writeError(w, http.StatusGatewayTimeout, "lookup timed out")
+		return
+	}
+	if errors.Is(err, errOdesliUnavailable) {
+		writeError(w, http.StatusServiceUnavailable, "music service is unavailable")
+		return
+	}
+	if retryAfter, busy := odesliBusy(err); busy {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		}
+		writeError(w, http.StatusServiceUnavailable, "music service is busy")
+		return
+	}
+	if err != nil {
+		p.logWarn("odesli lookup failed", "err", err.Error())
+		writeError(w, http.StatusBadGateway, "lookup failed")
+		return
+	}
+	ent, ok := o.EntitiesByUniqueId[o.EntityUniqueId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no match for that link")
+		return
+	}
+
+	out := resolvedTrack{
+		Title:     ent.Title,
+		Artist:    ent.ArtistName,
+		Thumbnail: ent.ThumbnailUrl,
+		PageURL:   o.PageUrl,
+		Links:     map[string]string{},
+	}
+	for k, v := range o.LinksByPlatform {
+		if link, ok := normalizePlatformURL(v.Url); ok {
+			out.Links[k] = link
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// postAction calls the "Create music preview" menu item as userID.
+func postAction(p *Plugin, userID, postID string) *httptest.ResponseRecorder {
+	return postActionFromTeam(p, userID, postID, "")
+}
+
+func postActionFromTeam(p *Plugin, userID, postID, teamID string) *httptest.ResponseRecorder {
+	body := `{"post_id":"` + postID + `","team_id":"` + teamID + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/post-action", strings.NewReader(body))
+	r.Header.Set("Mattermost-User-Id", userID)
+	w := httptest.NewRecorder()
+	p.handlePostAction(w, r)
+	return w
+}
+
+func TestPostActionAttributesTheClicker(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	postID := model.NewId()
+	for _, tc := range []struct {
+		name       string
+		typ        model.ChannelType
+		wantAuthor string
+	}{
+		{"public channel", model.ChannelTypeOpen, testBotID},
+		// Never as the author of the post that was clicked.
+		{"DM", model.ChannelTypeDirect, "clicker"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{ShowRemoveButton: true}
+			newOdesliServer(t, cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withChannel(api, "channel1", tc.typ)
+			withUser(api, "clicker", "en")
+			api.On("GetPost", postID).Return(&model.Post{Id: postID, UserId: "author", ChannelId: "channel1", Message: link}, nil)
+			api.On("HasPermissionToChannel", "clicker", "channel1", mock.Anything).Return(true)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			w := postAction(p, "clicker", postID)
+			waitForWork(t, p)
+
+			assert.Equal(t, http.StatusAccepted, w.Code)
+			require.Len(t, posts(), 1)
+			assert.Equal(t, tc.wantAuthor, posts()[0].UserId)
+			assert.NotEqual(t, "author", storedPosterID(posts()[0]))
+		})
+	}
+}
+
+func TestPostActionRestrictions(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	postID, teamID, otherTeamID := model.NewId(), model.NewId(), model.NewId()
+
+	setup := func(t *testing.T, cfg *Config, typ model.ChannelType) (*Plugin, func() []*model.Post, *[]string) {
+		newOdesliServer(t, cfg, serveFixture(t, "song"))
+		api := newTestAPI(t)
+		withUser(api, "clicker", "en")
+		channelTeam := teamID
+		if typ == model.ChannelTypeDirect {
+			channelTeam = ""
+		}
+		api.On("GetChannel", "channel1").Return(&model.Channel{Id: "channel1", Type: typ, TeamId: channelTeam}, nil)
+		api.On("GetPost", postID).Return(&model.Post{Id: postID, UserId: "author", ChannelId: "channel1", Message: link}, nil)
+		api.On("HasPermissionToChannel", "clicker", "channel1", mock.Anything).Return(true)
+		api.On("HasPermissionTo", "clicker", model.PermissionManageSystem).Return(false).Maybe()
+		api.On("GetTeamMember", teamID, "clicker").Return(&model.TeamMember{}, nil).Maybe()
+		api.On("GetTeamMember", otherTeamID, "clicker").Return(nil, model.NewAppError("GetTeamMember", "app.team.get_member.missing.app_error", nil, "", http.StatusNotFound)).Maybe()
+		var told []string
+		api.On("SendEphemeralPost", "clicker", mock.Anything).Run(func(args mock.Arguments) {
+			told = append(told, args.Get(1).(*model.Post).Message)
+		}).Return(&model.Post{}).Maybe()
+		posts := recordPosts(api)
+		return newTestPlugin(t, api, cfg), posts, &told
+	}
+
+	t.Run("system admins only", func(t *testing.T) {
+		p, posts, told := setup(t, &Config{RestrictToSystemAdmins: true}, model.ChannelTypeOpen)
+		w := postAction(p, "clicker", postID)
+		waitForWork(t, p)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "not_permitted")
+		assert.Empty(t, posts())
+		assert.Equal(t, []string{tr("en", "not_permitted")}, *told)
+	})
+
+	t.Run("team not allowed", func(t *testing.T) {
+		p, posts, _ := setup(t, &Config{AllowedTeamIDs: otherTeamID}, model.ChannelTypeOpen)
+		// The channel's team counts, whatever the client says.
+		postActionFromTeam(p, "clicker", postID, otherTeamID)
+		waitForWork(t, p)
+		assert.Empty(t, posts())
+	})
+
+	t.Run("DM counts against the current team", func(t *testing.T) {
+		p, posts, _ := setup(t, &Config{AllowedTeamIDs: teamID}, model.ChannelTypeDirect)
+		postActionFromTeam(p, "clicker", postID, teamID)
+		waitForWork(t, p)
+		assert.Len(t, posts(), 1)
+	})
+
+	t.Run("DM from a team the user isn't in", func(t *testing.T) {
+		p, posts, _ := setup(t, &Config{AllowedTeamIDs: otherTeamID}, model.ChannelTypeDirect)
+		postActionFromTeam(p, "clicker", postID, otherTeamID)
+		waitForWork(t, p)
+		assert.Empty(t, posts())
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		p, posts, told := setup(t, &Config{CommandsPerMinute: 1}, model.ChannelTypeOpen)
+		postAction(p, "clicker", postID)
+		w := postAction(p, "clicker", postID)
+		waitForWork(t, p)
+		assert.Contains(t, w.Body.String(), "too_fast")
+		assert.Len(t, posts(), 1)
+		assert.Equal(t, []string{tr("en", "too_fast")}, *told)
+	})
+}
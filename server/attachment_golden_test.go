@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run "go test -run TestAttachmentGolden -update" to rewrite the golden
+// files after an intended rendering change, and review the diff.
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+func TestAttachmentGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fixture string
+		cfg     *Config
+	}{
+		{"song", "song", &Config{}},
+		{"song_compact", "song", &Config{CompactMode: true}},
+		{"song_buttons", "song", &Config{LinkButtons: true}},
+		{"album", "album", &Config{}},
+		{"empty_artist", "empty_artist", &Config{}},
+		{"no_thumbnail", "no_thumbnail", &Config{}},
+		{"no_links", "no_links", &Config{}},
+		{"episode", "episode", &Config{}},
+		{"malformed_links", "malformed_links", &Config{}},
+		{"many_platforms", "many_platforms", &Config{}},
+		{"many_platforms_all_chips", "many_platforms", &Config{MaxChips: -1}},
+		{"many_platforms_copy_all", "many_platforms", &Config{CopyAllLinks: true, MaxChips: 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var o OdesliResult
+			require.NoError(t, json.Unmarshal(readFixture(t, tc.fixture), &o))
+			got, err := json.MarshalIndent(buildAttachment(&o, tc.cfg, "en"), "", "  ")
+			require.NoError(t, err)
+			got = append(got, '\n')
+
+			path := filepath.Join("testdata", "golden", tc.name+".json")
+			if *updateGolden {
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				require.NoError(t, os.WriteFile(path, got, 0o644))
+				return
+			}
+			want, err := os.ReadFile(path)
+			require.NoError(t, err, "missing golden file; run with -update")
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
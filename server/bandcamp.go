@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"golang.org/x/net/html"
+)
+
+// ---- Bandcamp fallback ----
+//
+// Odesli knows little about Bandcamp, but every album/track page embeds
+// JSON-LD and og: tags with everything a card needs.
+
+const (
+	bandcampTimeout      = 5 * time.Second
+	maxBandcampPageBytes = 2 << 20
+)
+
+var errNotMusicPage = errors.New("not a bandcamp album or track page")
+
+type bandcampInfo struct {
+	Title  string
+	Artist string
+	Image  string
+	Price  string
+}
+
+type ldOffer struct {
+	Price         float64 `json:"price"`
+	PriceCurrency string  `json:"priceCurrency"`
+}
+
+type bandcampLD struct {
+	Type     json.RawMessage `json:"@type"`
+	Name     string          `json:"name"`
+	ByArtist struct {
+		Name string `json:"name"`
+	} `json:"byArtist"`
+	Image        json.RawMessage `json:"image"`
+	Offers       *ldOffer        `json:"offers"`
+	AlbumRelease []struct {
+		Offers *ldOffer `json:"offers"`
+	} `json:"albumRelease"`
+}
+
+func isBandcampURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	host := asciiHost(u.Hostname())
+	return host == "bandcamp.com" || strings.HasSuffix(host, ".bandcamp.com")
+}
+
+// lookupBandcamp builds a card straight from a Bandcamp page.
+func (p *Plugin) lookupBandcamp(ctx context.Context, pageURL string) (*model.SlackAttachment, previewTrack, error) {
+	info, err := p.fetchBandcampPage(ctx, pageURL)
+	if err != nil {
+		return nil, previewTrack{}, err
+	}
+	return info.attachment(pageURL, p.config()), info.track(pageURL), nil
+}
+
+func (p *Plugin) fetchBandcampPage(ctx context.Context, pageURL string) (*bandcampInfo, error) {
+	if err := checkPublicURL(pageURL); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, bandcampTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mattermost-Songlink-Plugin/0.1")
+
+	res, err := p.publicClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("bandcamp status %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "text/html") {
+		return nil, errNotMusicPage
+	}
+
+	return parseBandcampPage(io.LimitReader(res.Body, maxBandcampPageBytes))
+}
+
+// parseBandcampPage pulls card details out of the page head. It prefers
+// JSON-LD and falls back to og: tags.
+func parseBandcampPage(r io.Reader) (*bandcampInfo, error) {
+	var (
+		ld       *bandcampLD
+		og       = map[string]string{}
+		inLDJSON bool
+	)
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			}
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.Data {
+			case "script":
+				inLDJSON = attr(tok, "type") == "application/ld+json"
+			case "meta":
+				if prop := attr(tok, "property"); strings.HasPrefix(prop, "og:") {
+					og[prop] = attr(tok, "content")
+				}
+			case "body":
+				// Everything we need lives in <head>.
+				return bandcampInfoFrom(ld, og)
+			}
+		case html.TextToken:
+			if inLDJSON && ld == nil {
+				var candidate bandcampLD
+				if json.Unmarshal([]byte(tok.Data), &candidate) == nil && isMusicLDType(candidate.Type) {
+					ld = &candidate
+				}
+			}
+		case html.EndTagToken:
+			if tok.Data == "script" {
+				inLDJSON = false
+			}
+		}
+	}
+	return bandcampInfoFrom(ld, og)
+}
+
+func bandcampInfoFrom(ld *bandcampLD, og map[string]string) (*bandcampInfo, error) {
+	if ld != nil && strings.TrimSpace(ld.Name) != "" {
+		info := &bandcampInfo{
+			Title:  strings.TrimSpace(ld.Name),
+			Artist: strings.TrimSpace(ld.ByArtist.Name),
+			Image:  firstImage(ld.Image),
+		}
+		if info.Image == "" {
+			info.Image = og["og:image"]
+		}
+		offer := ld.Offers
+		for _, rel := range ld.AlbumRelease {
+			if offer == nil && rel.Offers != nil {
+				offer = rel.Offers
+			}
+		}
+		if offer != nil && offer.Price > 0 && offer.PriceCurrency != "" {
+			info.Price = fmt.Sprintf("%.2f %s", offer.Price, offer.PriceCurrency)
+		}
+		return info, nil
+	}
+
+	// No usable JSON-LD: trust og: tags only for album/track pages.
+	if t := og["og:type"]; t != "album" && t != "song" {
+		return nil, errNotMusicPage
+	}
+	title := strings.TrimSpace(og["og:title"])
+	if title == "" {
+		return nil, errNotMusicPage
+	}
+	info := &bandcampInfo{Title: title, Image: og["og:image"]}
+	// Bandcamp formats og:title as "Title, by Artist".
+	if t, a, ok := strings.Cut(title, ", by "); ok {
+		info.Title, info.Artist = strings.TrimSpace(t), strings.TrimSpace(a)
+	}
+	return info, nil
+}
+
+func (b *bandcampInfo) attachment(pageURL string, cfg *Config) *model.SlackAttachment {
+	title := joinHeading(b.Artist, b.Title)
+	att := &model.SlackAttachment{
+		Fallback:  title,
+		Title:     title,
+		TitleLink: pageURL,
+		Text:      fmt.Sprintf("[Bandcamp](%s)", pageURL),
+		Color:     providerColor("BANDCAMP"),
+	}
+	if cfg == nil || !cfg.CompactMode {
+		att.ThumbURL = b.Image
+		if b.Price != "" {
+			att.Fields = []*model.SlackAttachmentField{{Title: "Price", Value: b.Price, Short: true}}
+		}
+	}
+	return att
+}
+
+func (b *bandcampInfo) track(pageURL string) previewTrack {
+	return previewTrack{Title: b.Title, Artist: b.Artist, PageURL: pageURL, Links: map[string]string{"bandcamp": pageURL}}
+}
+
+func isMusicLDType(raw json.RawMessage) bool {
+	return bytes.Contains(raw, []byte(`"MusicAlbum"`)) || bytes.Contains(raw, []byte(`"MusicRecording"`))
+}
+
+// firstImage handles JSON-LD image being either a string or a list.
+func firstImage(raw json.RawMessage) string {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) == nil && len(many) > 0 {
+		return many[0]
+	}
+	return ""
+}
+
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const bandcampPage = `<html><head>
+<meta property="og:type" content="song">
+<meta property="og:title" content="Untitled Demo, by Some Artist">
+<meta property="og:image" content="https://f4.bcbits.com/img/a1_10.jpg">
+</head><body></body></html>`
+
+// serveBandcamp answers every request for a Bandcamp page with page, by
+// pointing p's client for user-supplied URLs at a local server.
+func serveBandcamp(t *testing.T, p *Plugin, page string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page))
+	}))
+	t.Cleanup(srv.Close)
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	p.publicTr.Store(tr)
+}
+
+func TestBandcampFallback(t *testing.T) {
+	const link = "http://artist.bandcamp.com/track/untitled-demo"
+	for _, tc := range []struct {
+		name      string
+		fixture   string // "" for an Odesli error
+		fallback  bool
+		wantTitle string
+	}{
+		{"odesli fails", "", true, "Some Artist — Untitled Demo"},
+		{"degenerate result", "degenerate", true, "Some Artist — Untitled Demo"},
+		{"usable result", "title_only", true, "Untitled Demo"},
+		{"fallback off", "degenerate", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{BandcampFallback: tc.fallback}
+			handler := http.NotFound
+			if tc.fixture != "" {
+				handler = serveFixture(t, tc.fixture)
+			}
+			newOdesliServer(t, cfg, handler)
+			p := newTestPlugin(t, newTestAPI(t), cfg)
+			serveBandcamp(t, p, bandcampPage)
+
+			att, _, err := p.lookupOdesli(link, "")
+			if tc.wantTitle == "" {
+				assert.ErrorIs(t, err, errNoLinks)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantTitle, att.Title)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Bot posting health ----
+//
+// EnsureBotUser can hand back an id for a bot that can't actually post (bot
+// accounts disabled, bot deactivated). Rather than failing every unfurl, stop
+// posting as the bot for a while once that is detected.
+
+const (
+	botFailureThreshold = 3
+	botSuspendFor       = 15 * time.Minute
+)
+
+var errBotUnavailable = errors.New("bot posting is suspended after repeated failures")
+
+type botHealth struct {
+	mu             sync.Mutex
+	failures       int
+	suspendedUntil time.Time
+	suspensions    int
+}
+
+func (h *botHealth) available(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !now.Before(h.suspendedUntil)
+}
+
+func (h *botHealth) recordSuccess() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = 0
+}
+
+// recordFailure counts a failed bot post. It suspends bot posting on the
+// threshold, or straight away when the bot is known to be disabled, and
+// reports whether this call started a suspension.
+func (h *botHealth) recordFailure(now time.Time, disabled bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	if !disabled && h.failures < botFailureThreshold {
+		return false
+	}
+	h.failures = 0
+	h.suspendedUntil = now.Add(botSuspendFor)
+	h.suspensions++
+	return true
+}
+
+func (h *botHealth) snapshot(now time.Time) map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := map[string]any{
+		"bot_posting":     "ok",
+		"bot_failures":    h.failures,
+		"bot_suspensions": h.suspensions,
+	}
+	if now.Before(h.suspendedUntil) {
+		out["bot_posting"] = "suspended"
+		out["bot_suspended_until"] = h.suspendedUntil.UTC().Format(time.RFC3339)
+	}
+	return out
+}
+
+// createBotPost posts as the bot, tracking failures so a bot that can't post
+// doesn't get retried on every message. It returns the created post.
+func (p *Plugin) createBotPost(post *model.Post) (*model.Post, error) {
+	now := time.Now()
+	if !p.botHealth.available(now) {
+		return nil, errBotUnavailable
+	}
+	botID := p.ensureBot()
+	if botID == "" {
+		return nil, errors.New("bot user unavailable")
+	}
+	post.UserId = botID
+
+	created, appErr := p.createPost(post)
+	if isNotChannelMember(appErr) && p.isOpenChannel(post.ChannelId) {
+		// Join once and try again; the bot may never have been added here.
+		// Private channels are left to their members to invite it.
+		p.logDebug("bot isn't a channel member, joining", "channel_id", post.ChannelId, "err", appErr.Error())
+		if _, mErr := p.API.AddChannelMember(post.ChannelId, botID); mErr != nil {
+			p.logWarn("failed to add the bot to the channel", "channel_id", post.ChannelId, "err", mErr.Error())
+		} else {
+			created, appErr = p.createPost(post)
+		}
+	}
+	if appErr != nil {
+		if isRateLimited(appErr) || appErr == errPluginStopping || isNotChannelMember(appErr) {
+			// The server is busy, we're shutting down or the bot can't join
+			// this one channel; the bot itself isn't broken.
+			return nil, appErr
+		}
+		user, uErr := p.API.GetUser(botID)
+		disabled := uErr == nil && user.DeleteAt != 0
+		if p.botHealth.recordFailure(now, disabled) {
+			// Warn once per suspension rather than on every message.
+			p.logWarn("Songlink bot can't post; pausing bot posts. Check that bot accounts are enabled and the songlink bot is active.",
+				"paused_for", botSuspendFor.String(), "bot_deactivated", disabled, "err", appErr.Error())
+		}
+		return nil, appErr
+	}
+	p.botHealth.recordSuccess()
+	return created, nil
+}
+
+// isOpenChannel reports whether channelID is a public channel, the only
+// kind the bot joins by itself.
+func (p *Plugin) isOpenChannel(channelID string) bool {
+	ch, appErr := p.API.GetChannel(channelID)
+	return appErr == nil && ch.Type == model.ChannelTypeOpen
+}
+
+// notChannelMember is isNotChannelMember for errors from createBotPost.
+func notChannelMember(err error) bool {
+	var appErr *model.AppError
+	return errors.As(err, &appErr) && isNotChannelMember(appErr)
+}
+
+// notMemberErrorIDs are the ids of the errors the server refuses a post with
+// when its author isn't a member of the channel. Other permission errors
+// (read-only channels, archived channels) aren't fixed by joining.
+var notMemberErrorIDs = map[string]bool{
+	"app.channel.get_member.missing.app_error":       true,
+	"store.sql_channel.get_member.missing.app_error": true,
+}
+
+// isNotChannelMember reports whether a post was refused because its author
+// isn't a member of the channel.
+func isNotChannelMember(appErr *model.AppError) bool {
+	return appErr != nil && notMemberErrorIDs[appErr.Id]
+}
+
+func (p *Plugin) handleHealth(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	status := p.botHealth.snapshot(now)
+	for k, v := range p.breaker.snapshot(now) {
+		status[k] = v
+	}
+	status["status"] = "ok"
+	if status["bot_posting"] != "ok" || status["odesli"] != "ok" {
+		status["status"] = "degraded"
+	}
+	writeJSON(w, http.StatusOK, status)
+}
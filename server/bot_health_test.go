@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var errNotMember = model.NewAppError("GetChannelMember", "app.channel.get_member.missing.app_error", nil, "", http.StatusNotFound)
+
+func TestIsNotChannelMember(t *testing.T) {
+	assert.False(t, isNotChannelMember(nil))
+	assert.True(t, isNotChannelMember(errNotMember))
+	assert.True(t, isNotChannelMember(model.NewAppError("GetMember", "store.sql_channel.get_member.missing.app_error", nil, "", http.StatusNotFound)))
+	// Other refusals aren't fixed by joining the channel.
+	assert.False(t, isNotChannelMember(model.NewAppError("Permissions", "api.context.permissions.app_error", nil, "", http.StatusForbidden)))
+	assert.False(t, isNotChannelMember(model.NewAppError("CreatePost", "api.post.create_post.town_square_read_only", nil, "", http.StatusForbidden)))
+
+	assert.True(t, notChannelMember(error(errNotMember)))
+	assert.False(t, notChannelMember(errBotUnavailable))
+}
+
+func TestCreateBotPostJoinsChannel(t *testing.T) {
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	api.On("CreatePost", mock.Anything).Return(nil, errNotMember).Once()
+	api.On("AddChannelMember", "channel1", testBotID).Return(&model.ChannelMember{}, nil).Once()
+	api.On("CreatePost", mock.Anything).Return(&model.Post{Id: "created"}, nil).Once()
+	p := newTestPlugin(t, api, &Config{})
+
+	created, err := p.createBotPost(&model.Post{ChannelId: "channel1"})
+	require.NoError(t, err)
+	assert.Equal(t, "created", created.Id)
+}
+
+func TestUnfurlFallsBackToEphemeralWhenBotCantJoin(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		typ    model.ChannelType
+		joined bool // whether the bot tries to join
+	}{
+		// Never added to a private channel behind its members' backs.
+		{"private channel", model.ChannelTypePrivate, false},
+		{"public channel refuses the join", model.ChannelTypeOpen, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			withChannel(api, "channel1", tc.typ)
+			api.On("CreatePost", mock.Anything).Return(nil, errNotMember).Once()
+			if tc.joined {
+				api.On("AddChannelMember", "channel1", testBotID).Return(nil, errNotMember).Once()
+			}
+			var ephemeral *model.Post
+			api.On("SendEphemeralPost", "sharer", mock.Anything).Run(func(args mock.Arguments) {
+				ephemeral = args.Get(1).(*model.Post)
+			}).Return(&model.Post{}).Once()
+			p := newTestPlugin(t, api, &Config{ShowRemoveButton: true})
+
+			err := p.postUnfurl("channel1", "root1", "sharer", &model.SlackAttachment{Title: "Song"}, previewTrack{})
+			assert.True(t, notChannelMember(err))
+			if !tc.joined {
+				api.AssertNotCalled(t, "AddChannelMember", mock.Anything, mock.Anything)
+			}
+			require.NotNil(t, ephemeral)
+			require.Len(t, ephemeral.Attachments(), 1)
+			// No Remove button for a post that doesn't exist.
+			assert.Empty(t, ephemeral.Attachments()[0].Actions)
+			// A bot that can't join one channel isn't broken.
+			assert.True(t, p.botHealth.available(time.Now()))
+		})
+	}
+}
+
+func TestCreateBotPostDoesNotJoinOnOtherErrors(t *testing.T) {
+	api := newTestAPI(t)
+	readOnly := model.NewAppError("CreatePost", "api.post.create_post.town_square_read_only", nil, "", http.StatusForbidden)
+	api.On("CreatePost", mock.Anything).Return(nil, readOnly).Once()
+	api.On("GetUser", testBotID).Return(&model.User{Id: testBotID}, nil)
+	p := newTestPlugin(t, api, &Config{})
+
+	_, err := p.createBotPost(&model.Post{ChannelId: "channel1"})
+	assert.Equal(t, error(readOnly), err)
+	api.AssertNotCalled(t, "AddChannelMember", mock.Anything, mock.Anything)
+}
+
+// health calls the health endpoint and decodes its status.
+func health(t *testing.T, p *Plugin) map[string]any {
+	w := httptest.NewRecorder()
+	p.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/v1/health", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var status map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+var errPostDenied = model.NewAppError("CreatePost", "api.context.permissions.app_error", nil, "", http.StatusForbidden)
+
+func TestBotPostingSuspendedAfterRepeatedFailures(t *testing.T) {
+	api := newTestAPI(t)
+	api.On("CreatePost", mock.Anything).Return(nil, errPostDenied).Times(botFailureThreshold)
+	api.On("GetUser", testBotID).Return(&model.User{Id: testBotID}, nil)
+	p := newTestPlugin(t, api, &Config{})
+	assert.Equal(t, "ok", health(t, p)["status"])
+
+	for i := range botFailureThreshold {
+		assert.True(t, p.botHealth.available(time.Now()), "failure %d", i)
+		_, err := p.createBotPost(&model.Post{ChannelId: "channel1"})
+		assert.Equal(t, error(errPostDenied), err)
+	}
+	assert.False(t, p.botHealth.available(time.Now()))
+
+	// Suspended: no more attempts until the pause is over.
+	_, err := p.createBotPost(&model.Post{ChannelId: "channel1"})
+	assert.ErrorIs(t, err, errBotUnavailable)
+	api.AssertNumberOfCalls(t, "CreatePost", botFailureThreshold)
+
+	status := health(t, p)
+	assert.Equal(t, "degraded", status["status"])
+	assert.Equal(t, "suspended", status["bot_posting"])
+	assert.NotEmpty(t, status["bot_suspended_until"])
+	assert.EqualValues(t, 1, status["bot_suspensions"])
+}
+
+func TestDeactivatedBotSuspendsAtOnce(t *testing.T) {
+	api := newTestAPI(t)
+	api.On("CreatePost", mock.Anything).Return(nil, errPostDenied).Once()
+	api.On("GetUser", testBotID).Return(&model.User{Id: testBotID, DeleteAt: model.GetMillis()}, nil)
+	p := newTestPlugin(t, api, &Config{})
+
+	_, err := p.createBotPost(&model.Post{ChannelId: "channel1"})
+	assert.Equal(t, error(errPostDenied), err)
+	assert.False(t, p.botHealth.available(time.Now()))
+	assert.Equal(t, "degraded", health(t, p)["status"])
+}
+
+func TestUnfurlSkippedWhileBotSuspended(t *testing.T) {
+	cfg := &Config{AutoUnfurl: true}
+	requests := 0
+	song := serveFixture(t, "song")
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		song(w, r)
+	})
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	withChannel(api, "dm1", model.ChannelTypeDirect)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+	p.botHealth.recordFailure(time.Now(), true)
+
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	p.unfurl(&model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link}, link)
+	assert.Empty(t, posts())
+	assert.Zero(t, requests, "not even looked up")
+
+	// Unfurls posted as the sharer don't need the bot.
+	p.unfurl(&model.Post{Id: "post2", UserId: "sharer", ChannelId: "dm1", Message: link}, link)
+	require.Len(t, posts(), 1)
+	assert.Equal(t, "sharer", posts()[0].UserId)
+}
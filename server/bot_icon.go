@@ -0,0 +1,36 @@
+package main
+
+import _ "embed"
+
+// ---- Bot profile image ----
+//
+// Uploaded once per bot account so the bot isn't shown with the generic
+// avatar. The KV flag holds the bot id the image was set for, so restarts
+// don't re-upload it.
+
+const botIconKey = "bot_icon_set"
+
+//go:embed assets/bot-icon.png
+var botIcon []byte
+
+// ensureBotIcon sets the bot's profile image if it hasn't been set yet.
+func (p *Plugin) ensureBotIcon(botID string) {
+	if botID == "" {
+		return
+	}
+	done, appErr := p.API.KVGet(botIconKey)
+	if appErr != nil {
+		p.logWarn("failed to read bot icon flag", "err", appErr.Error())
+		return
+	}
+	if string(done) == botID {
+		return
+	}
+	if appErr := p.API.SetProfileImage(botID, botIcon); appErr != nil {
+		p.logWarn("failed to set the bot profile image", "bot_id", botID, "err", appErr.Error())
+		return
+	}
+	if appErr := p.API.KVSet(botIconKey, []byte(botID)); appErr != nil {
+		p.logWarn("failed to save bot icon flag", "err", appErr.Error())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureBotUserCalledOnce(t *testing.T) {
+	cfg := &Config{AutoUnfurl: true}
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	for i := range 5 {
+		link := fmt.Sprintf("https://open.spotify.com/track/track%d", i)
+		p.MessageWillBePosted(nil, &model.Post{Id: model.NewId(), UserId: "sharer", ChannelId: "channel1", Message: link})
+	}
+	waitForWork(t, p)
+
+	require.Len(t, posts(), 5)
+	api.AssertNumberOfCalls(t, "EnsureBotUser", 1)
+}
+
+func TestEnsureBotRetriesAfterFailure(t *testing.T) {
+	api := plugintest.NewAPI(t)
+	api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("EnsureBotUser", mock.Anything).Return("", errors.New("bots disabled")).Once()
+	api.On("EnsureBotUser", mock.Anything).Return(testBotID, nil).Once()
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	assert.Empty(t, p.ensureBot())
+	assert.Equal(t, testBotID, p.ensureBot())
+	// Cached from here on: the mock would fail a third call.
+	assert.Equal(t, testBotID, p.ensureBot())
+	api.AssertNumberOfCalls(t, "EnsureBotUser", 2)
+}
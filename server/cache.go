@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Lookup cache ----
+//
+// Odesli responses are cached, not rendered attachments, so rendering
+// settings (compact mode, labels, …) apply immediately after a config change.
+// The cache is an LRU bounded by CacheMaxEntries; expired entries are dropped
+// when they are next looked at or fall off the end.
+
+const (
+	defaultCacheTTL        = time.Hour
+	defaultCacheMaxEntries = 1000
+)
+
+type cacheEntry struct {
+	key     string
+	resp    *OdesliResult
+	added   time.Time
+	expires time.Time
+}
+
+type lookupCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element // values are *cacheEntry
+	order      *list.List               // front is most recently used
+	maxEntries int
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+		maxEntries: defaultCacheMaxEntries,
+	}
+}
+
+// cacheKey identifies a lookup: the normalized URL plus the country it was
+// resolved for.
+func cacheKey(musicURL, country string) string {
+	return country + "|" + musicURL
+}
+
+func (c *lookupCache) get(key string) (*OdesliResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.resp, true
+}
+
+func (c *lookupCache) set(key string, resp *OdesliResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e := &cacheEntry{key: key, resp: resp, added: now, expires: now.Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(e)
+	c.evict()
+}
+
+// retune changes an existing entry's lifetime, counted from when it was added.
+func (c *lookupCache) retune(key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.expires = e.added.Add(ttl)
+	}
+}
+
+// setLimit changes the maximum entry count, evicting if it shrank.
+func (c *lookupCache) setLimit(n int) {
+	if n <= 0 {
+		n = defaultCacheMaxEntries
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = n
+	c.evict()
+}
+
+// evict drops least recently used entries beyond the limit. Callers hold mu.
+func (c *lookupCache) evict() {
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lookupCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// clear drops every entry and returns how many there were.
+func (c *lookupCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+	return n
+}
+
+// size returns the entry count and limit.
+func (c *lookupCache) size() (n, limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.maxEntries
+}
+
+// cacheTTLDefault is CacheTTLMinutes, or an hour when unset.
+func (c *Config) cacheTTLDefault() time.Duration {
+	if c == nil || c.CacheTTLMinutes <= 0 {
+		return defaultCacheTTL
+	}
+	return time.Duration(c.CacheTTLMinutes) * time.Minute
+}
+
+// ---- TTL policy ----
+//
+// Availability of brand-new releases changes quickly while catalog tracks are
+// stable, so when the release date is known (currently via Spotify
+// enrichment) new releases are cached briefly and old ones for longer.
+
+const (
+	defaultNewReleaseTTL = 10 * time.Minute
+	defaultCatalogTTL    = 24 * time.Hour
+)
+
+// cacheTTL maps a release date to a cache lifetime. A zero release date, or
+// NewReleaseDays unset, gives CacheTTLMinutes.
+func (c *Config) cacheTTL(released, now time.Time) time.Duration {
+	if c == nil || c.NewReleaseDays <= 0 || released.IsZero() {
+		return c.cacheTTLDefault()
+	}
+	if now.Sub(released) < time.Duration(c.NewReleaseDays)*24*time.Hour {
+		if c.NewReleaseCacheMinutes > 0 {
+			return time.Duration(c.NewReleaseCacheMinutes) * time.Minute
+		}
+		return defaultNewReleaseTTL
+	}
+	if c.CatalogCacheHours > 0 {
+		return time.Duration(c.CatalogCacheHours) * time.Hour
+	}
+	return defaultCatalogTTL
+}
+
+// ---- /songlink cache ----
+
+// executeCache handles "/songlink cache clear|stats" for system admins. The
+// cache is in memory, so both act on the server node that ran the command.
+func (p *Plugin) executeCache(userID string, in commandInput) *model.CommandResponse {
+	locale := p.userLocale(userID)
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		return p.textResponse(tr(locale, "cache_forbidden"))
+	}
+	usage := tr(locale, "cache_usage", p.config().commandTrigger())
+	if p.cache == nil || len(in.Words) == 0 {
+		return p.textResponse(usage)
+	}
+	switch strings.ToLower(in.Words[0]) {
+	case "clear":
+		n := p.cache.clear()
+		p.logInfo("lookup cache cleared", "user_id", userID, "entries", n)
+		return p.textResponse(tr(locale, "cache_cleared", n))
+	case "stats":
+		n, limit := p.cache.size()
+		hits, misses := p.metrics.cacheHits.Load(), p.metrics.cacheMisses.Load()
+		rate := tr(locale, "cache_rate_none")
+		if total := hits + misses; total > 0 {
+			rate = fmt.Sprintf("%.1f%%", float64(hits)*100/float64(total))
+		}
+		return p.textResponse(tr(locale, "cache_stats", n, limit, hits, misses, rate))
+	default:
+		return p.textResponse(usage)
+	}
+}
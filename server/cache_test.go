@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteCache(t *testing.T) {
+	api := newTestAPI(t)
+	withUser(api, "admin", "en")
+	withUser(api, "member", "de")
+	api.On("HasPermissionTo", "admin", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", "member", model.PermissionManageSystem).Return(false)
+	p := newTestPlugin(t, api, &Config{})
+	p.cache.set(cacheKey("https://open.spotify.com/track/1", ""), &OdesliResult{}, time.Hour)
+
+	run := func(userID string, words ...string) string {
+		return p.executeCache(userID, commandInput{Words: words}).Text
+	}
+
+	assert.Equal(t, "Nur System-Admins können den Cache verwalten.", run("member", "clear"))
+	assert.Equal(t, "Usage: /songlink cache clear|stats", run("admin"))
+	assert.Contains(t, run("admin", "stats"), "- Entries: 1 of ")
+	assert.Contains(t, run("admin", "stats"), "- Hit rate: n/a")
+	assert.Equal(t, "Cleared 1 cached lookups.", run("admin", "clear"))
+	assert.Contains(t, run("admin", "stats"), "- Entries: 0 of ")
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	policy := &Config{CacheTTLMinutes: 30, NewReleaseDays: 14, NewReleaseCacheMinutes: 5, CatalogCacheHours: 48}
+	for _, tc := range []struct {
+		name     string
+		cfg      *Config
+		released time.Time
+		want     time.Duration
+	}{
+		{"new release", policy, daysAgo(3), 5 * time.Minute},
+		{"just inside the window", policy, daysAgo(14).Add(time.Minute), 5 * time.Minute},
+		{"catalog", policy, daysAgo(14), 48 * time.Hour},
+		{"unknown release date", policy, time.Time{}, 30 * time.Minute},
+		{"policy off", &Config{CacheTTLMinutes: 30}, daysAgo(3), 30 * time.Minute},
+		{"default new release TTL", &Config{NewReleaseDays: 14}, daysAgo(3), defaultNewReleaseTTL},
+		{"default catalog TTL", &Config{NewReleaseDays: 14}, daysAgo(400), defaultCatalogTTL},
+		{"no config", nil, daysAgo(3), defaultCacheTTL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.cfg.cacheTTL(tc.released, now))
+		})
+	}
+}
+
+func TestCacheRetune(t *testing.T) {
+	c := newLookupCache()
+	c.set("key", &OdesliResult{}, time.Hour)
+	c.retune("key", -time.Second)
+	_, ok := c.get("key")
+	assert.False(t, ok, "retuned into the past, so expired")
+	c.retune("missing", time.Hour) // no-op
+}
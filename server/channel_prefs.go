@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Per-channel settings ----
+//
+// AutoUnfurl is the default for every channel; "/songlink unfurl on|off"
+// overrides it for one channel.
+
+const channelPrefsKeyPrefix = "channel_prefs_"
+
+type channelPrefs struct {
+	// Unfurl overrides AutoUnfurl when set.
+	Unfurl *bool `json:"unfurl,omitempty"`
+}
+
+func (p *Plugin) channelPrefs(channelID string) channelPrefs {
+	var prefs channelPrefs
+	data, appErr := p.API.KVGet(channelPrefsKeyPrefix + channelID)
+	if appErr != nil {
+		p.logWarn("failed to load channel settings", "channel_id", channelID, "err", appErr.Error())
+		return prefs
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &prefs); err != nil {
+			p.logWarn("ignoring unreadable channel settings", "channel_id", channelID, "err", err.Error())
+		}
+	}
+	return prefs
+}
+
+// unfurlEnabled reports whether links posted in channelID are unfurled.
+func (p *Plugin) unfurlEnabled(channelID string) bool {
+	if prefs := p.channelPrefs(channelID); prefs.Unfurl != nil {
+		return *prefs.Unfurl
+	}
+	return p.config() != nil && p.config().AutoUnfurl
+}
+
+// canManageChannel reports whether userID may change channelID's settings:
+// channel admins for public and private channels, any member of a DM or GM.
+func (p *Plugin) canManageChannel(userID, channelID string) bool {
+	ch, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return false
+	}
+	perm := model.PermissionCreatePost
+	switch ch.Type {
+	case model.ChannelTypeOpen:
+		perm = model.PermissionManagePublicChannelProperties
+	case model.ChannelTypePrivate:
+		perm = model.PermissionManagePrivateChannelProperties
+	}
+	return p.API.HasPermissionToChannel(userID, channelID, perm)
+}
+
+// executeUnfurl handles "/songlink unfurl [on|off]" for the current channel.
+func (p *Plugin) executeUnfurl(args *model.CommandArgs, in commandInput) *model.CommandResponse {
+	locale := p.userLocale(args.UserId)
+	if len(in.Words) == 0 {
+		state := "off"
+		if p.unfurlEnabled(args.ChannelId) {
+			state = "on"
+		}
+		return p.textResponse(tr(locale, "unfurl_status_"+state, p.config().commandTrigger()))
+	}
+	var on bool
+	switch strings.ToLower(in.Words[0]) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return p.textResponse(tr(locale, "unfurl_usage", p.config().commandTrigger()))
+	}
+	if !p.canManageChannel(args.UserId, args.ChannelId) {
+		return p.textResponse(tr(locale, "unfurl_forbidden"))
+	}
+
+	_, err := kvUpdateJSON(p.API, channelPrefsKeyPrefix+args.ChannelId, func(prefs *channelPrefs) bool {
+		prefs.Unfurl = &on
+		return true
+	})
+	if err != nil {
+		p.API.LogError("failed to save channel settings", "channel_id", args.ChannelId, "err", err.Error())
+		return p.textResponse(tr(locale, "unfurl_save_failed"))
+	}
+	if on {
+		return p.textResponse(tr(locale, "unfurl_on"))
+	}
+	return p.textResponse(tr(locale, "unfurl_off"))
+}
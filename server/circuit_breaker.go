@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---- Odesli circuit breaker ----
+//
+// During an Odesli outage every lookup would otherwise sit through the full
+// timeout. After enough consecutive failures the breaker opens and lookups
+// fail straight away; once the cooldown is over one request is let through
+// to probe, and its outcome closes or reopens the breaker.
+
+const (
+	defaultBreakerFailures        = 5
+	defaultBreakerWindowSeconds   = 60
+	defaultBreakerCooldownSeconds = 30
+)
+
+var errOdesliUnavailable = errors.New("odesli is unavailable, lookups are paused")
+
+// probeToken identifies the half-open probe allow let through; 0 for other
+// requests.
+type probeToken uint64
+
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	threshold int // 0 = never open
+	window    time.Duration
+	cooldown  time.Duration
+
+	failures     int        // consecutive failures in the current streak
+	firstFailure time.Time  // when the streak started
+	openUntil    time.Time  // open while now is before this
+	probe        probeToken // the half-open probe in flight, 0 if none
+	lastProbe    probeToken
+	trips        int
+}
+
+// configure applies CircuitBreakerFailures, -WindowSeconds and
+// -CooldownSeconds. Zero means the default, a negative threshold turns the
+// breaker off.
+func (b *circuitBreaker) configure(c *Config) {
+	threshold, window, cooldown := defaultBreakerFailures, defaultBreakerWindowSeconds, defaultBreakerCooldownSeconds
+	if c != nil {
+		if c.CircuitBreakerFailures != 0 {
+			threshold = max(c.CircuitBreakerFailures, 0)
+		}
+		if c.CircuitBreakerWindowSeconds > 0 {
+			window = c.CircuitBreakerWindowSeconds
+		}
+		if c.CircuitBreakerCooldownSeconds > 0 {
+			cooldown = c.CircuitBreakerCooldownSeconds
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.window = time.Duration(window) * time.Second
+	b.cooldown = time.Duration(cooldown) * time.Second
+	if threshold == 0 {
+		b.failures, b.openUntil, b.probe = 0, time.Time{}, 0
+	}
+}
+
+// allow reports whether a request may go out now. Past the cooldown it lets
+// exactly one probe through, identified by the token, until that probe's
+// outcome is recorded or it is cancelled.
+func (b *circuitBreaker) allow(now time.Time) (probeToken, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 || b.openUntil.IsZero() {
+		return 0, true
+	}
+	if now.Before(b.openUntil) || b.probe != 0 {
+		return 0, false
+	}
+	b.lastProbe++
+	b.probe = b.lastProbe
+	return b.probe, true
+}
+
+// record notes the outcome of a request, with the token allow gave it. While
+// the breaker is open only the probe's outcome counts: requests that went out
+// before it opened say nothing about recovery.
+func (b *circuitBreaker) record(now time.Time, token probeToken, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 {
+		return
+	}
+	if !b.openUntil.IsZero() {
+		if token == 0 || token != b.probe {
+			return
+		}
+		b.probe = 0
+		if failed {
+			b.trips++
+			b.openUntil = now.Add(b.cooldown)
+			return
+		}
+	}
+	if !failed {
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.trips++
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// cancel gives up the probe with token without an outcome, for a request
+// that was cancelled, so the next request probes instead.
+func (b *circuitBreaker) cancel(token probeToken) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if token != 0 && token == b.probe {
+		b.probe = 0
+	}
+}
+
+// outageFailure reports whether err looks like Odesli being down: network
+// errors, timeouts, undecodable answers and 5xx. Unknown links and rate
+// limiting don't count.
+func outageFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *odesliStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+func (b *circuitBreaker) snapshot(now time.Time) map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[string]any{
+		"odesli":       "ok",
+		"odesli_trips": b.trips,
+	}
+	switch {
+	case b.openUntil.IsZero():
+	case now.Before(b.openUntil):
+		out["odesli"] = "unavailable"
+		out["odesli_retry_at"] = b.openUntil.UTC().Format(time.RFC3339)
+	default:
+		out["odesli"] = "recovering"
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBreaker(threshold int) *circuitBreaker {
+	b := &circuitBreaker{}
+	b.configure(&Config{CircuitBreakerFailures: threshold, CircuitBreakerWindowSeconds: 60, CircuitBreakerCooldownSeconds: 30})
+	return b
+}
+
+// failN records n failed requests at now.
+func failN(b *circuitBreaker, now time.Time, n int) {
+	for range n {
+		token, _ := b.allow(now)
+		b.record(now, token, true)
+	}
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(3)
+
+	failN(b, now, 2)
+	_, ok := b.allow(now)
+	assert.True(t, ok, "open before the threshold")
+
+	failN(b, now, 1)
+	_, ok = b.allow(now.Add(29 * time.Second))
+	assert.False(t, ok, "closed after the threshold")
+	assert.Equal(t, "unavailable", b.snapshot(now)["odesli"])
+	assert.Equal(t, 1, b.snapshot(now)["odesli_trips"])
+}
+
+func TestCircuitBreakerFailuresOutsideWindow(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(3)
+
+	failN(b, now, 2)
+	failN(b, now.Add(61*time.Second), 1)
+	_, ok := b.allow(now.Add(61 * time.Second))
+	assert.True(t, ok)
+
+	// A success ends the streak.
+	b = newTestBreaker(3)
+	failN(b, now, 2)
+	b.record(now, 0, false)
+	failN(b, now, 2)
+	_, ok = b.allow(now)
+	assert.True(t, ok)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(1)
+	failN(b, now, 1)
+	later := now.Add(31 * time.Second)
+
+	probe, ok := b.allow(later)
+	require.True(t, ok)
+	require.NotZero(t, probe)
+	_, ok = b.allow(later)
+	assert.False(t, ok, "a second probe while the first is in flight")
+	assert.Equal(t, "recovering", b.snapshot(later)["odesli"])
+
+	// A request from before the breaker opened finishing now doesn't
+	// decide anything.
+	b.record(later, 0, false)
+	_, ok = b.allow(later)
+	assert.False(t, ok)
+
+	// The probe failing reopens the breaker for another cooldown.
+	b.record(later, probe, true)
+	_, ok = b.allow(later.Add(29 * time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 2, b.snapshot(later)["odesli_trips"])
+
+	// The next probe succeeding closes it.
+	later = later.Add(31 * time.Second)
+	probe, ok = b.allow(later)
+	require.True(t, ok)
+	b.record(later, probe, false)
+	for range 3 {
+		token, ok := b.allow(later)
+		assert.True(t, ok)
+		assert.Zero(t, token)
+	}
+	assert.Equal(t, "ok", b.snapshot(later)["odesli"])
+}
+
+func TestCircuitBreakerStaleTokenIgnored(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(1)
+	failN(b, now, 1)
+	later := now.Add(31 * time.Second)
+	first, _ := b.allow(later)
+	b.cancel(first)
+
+	second, ok := b.allow(later)
+	require.True(t, ok, "cancelling the probe lets another one through")
+	assert.NotEqual(t, first, second)
+
+	b.record(later, first, false)
+	_, ok = b.allow(later)
+	assert.False(t, ok, "the cancelled probe's outcome closed the breaker")
+
+	b.record(later, second, false)
+	_, ok = b.allow(later)
+	assert.True(t, ok)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(-1)
+	failN(b, now, 100)
+	_, ok := b.allow(now)
+	assert.True(t, ok)
+	assert.Equal(t, "ok", b.snapshot(now)["odesli"])
+}
+
+func TestOutageFailure(t *testing.T) {
+	assert.False(t, outageFailure(nil))
+	assert.True(t, outageFailure(errors.New("connection refused")))
+	assert.True(t, outageFailure(&odesliStatusError{Code: http.StatusBadGateway}))
+	assert.False(t, outageFailure(&odesliStatusError{Code: http.StatusNotFound}))
+	assert.False(t, outageFailure(&odesliStatusError{Code: http.StatusTooManyRequests}))
+}
+
+func TestResolveCancelledDoesNotCount(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	now := time.Now()
+	b := newTestBreaker(1)
+	failN(b, now.Add(-31*time.Second), 1)
+	c := &OdesliClient{HTTPClient: srv.Client(), BaseURL: srv.URL, Breaker: b}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.Resolve(ctx, "https://open.spotify.com/track/1", "")
+		done <- err
+	}()
+	// Wait for the probe to be in flight, then cancel it.
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.probe != 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Error(t, <-done)
+
+	// Neither reopened nor closed: the next request probes.
+	assert.Equal(t, 1, b.snapshot(now)["odesli_trips"])
+	probe, ok := b.allow(now)
+	assert.True(t, ok)
+	assert.NotZero(t, probe)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// ---- Command argument parsing ----
+
+// commandInput is a parsed /songlink invocation.
+//
+//	/songlink [subcommand] [--flag[=value]…] [words…] [url…]
+//
+// Flags, URLs and plain words may appear in any order after the subcommand.
+type commandInput struct {
+	Trigger    string            // trigger word without the leading slash
+	Subcommand string            // lower-cased, empty when none was given
+	Flags      map[string]string // --name → "", --name=value → "value"
+	URLs       []string          // cleaned with cleanMusicURL, in input order
+	Words      []string          // everything else, in input order
+}
+
+// knownSubcommands are the words recognised as a subcommand when they appear
+// right after the trigger.
+var knownSubcommands = map[string]bool{
+	"cache":      true,
+	"help":       true,
+	"preview":    true,
+	"setcountry": true,
+	"stats":      true,
+	"test":       true,
+	"thread":     true,
+	"unfurl":     true,
+	"visibility": true,
+}
+
+// bareHostRegex matches URL-ish tokens typed without a scheme
+// (open.spotify.com/track/…).
+var bareHostRegex = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+/`)
+
+// parseCommand splits args.Command. It tolerates any amount of whitespace
+// between tokens and a missing or doubled leading slash on the trigger.
+func parseCommand(command string) commandInput {
+	in := commandInput{Flags: map[string]string{}}
+	tokens := strings.Fields(command)
+	if len(tokens) == 0 {
+		return in
+	}
+	in.Trigger = strings.TrimLeft(tokens[0], "/")
+	tokens = tokens[1:]
+
+	if len(tokens) > 0 && knownSubcommands[strings.ToLower(tokens[0])] {
+		in.Subcommand = strings.ToLower(tokens[0])
+		tokens = tokens[1:]
+	}
+
+	for _, tok := range tokens {
+		switch {
+		case strings.HasPrefix(tok, "--") && len(tok) > 2:
+			name, value, _ := strings.Cut(tok[2:], "=")
+			in.Flags[strings.ToLower(name)] = value
+		case isURLToken(tok):
+			in.URLs = append(in.URLs, cleanMusicURL(tok))
+		default:
+			in.Words = append(in.Words, tok)
+		}
+	}
+	return in
+}
+
+// empty reports whether nothing but the trigger was typed.
+func (in commandInput) empty() bool {
+	return in.Subcommand == "" && len(in.Flags) == 0 && len(in.URLs) == 0 && len(in.Words) == 0
+}
+
+// Caption is the plain words joined back together.
+func (in commandInput) Caption() string {
+	return strings.Join(in.Words, " ")
+}
+
+// HasFlag reports whether --name was given, with or without a value.
+func (in commandInput) HasFlag(name string) bool {
+	_, ok := in.Flags[name]
+	return ok
+}
+
+// country returns the --country=XX override as normalizeCountry gives it,
+// or "" when none was given. ok is false when the flag is present but isn't
+// a known country code.
+func (in commandInput) country() (code string, ok bool) {
+	v, given := in.Flags["country"]
+	if !given {
+		return "", true
+	}
+	return normalizeCountry(v)
+}
+
+// isCountryCode reports whether s looks like an ISO 3166-1 alpha-2 code.
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeCountry upper-cases s and checks it against the ISO 3166-1
+// alpha-2 country codes, mapping deprecated ones (UK) to their replacement.
+func normalizeCountry(s string) (string, bool) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	if !isCountryCode(code) {
+		return "", false
+	}
+	region, err := language.ParseRegion(code)
+	if err != nil || !region.IsCountry() {
+		return "", false
+	}
+	return region.Canonicalize().String(), true
+}
+
+func isURLToken(tok string) bool {
+	tok = strings.Trim(tok, "<>")
+	lower := strings.ToLower(tok)
+	for _, scheme := range []string{"http://", "https://"} {
+		if strings.HasPrefix(lower, scheme) {
+			return len(tok) > len(scheme)
+		}
+	}
+	return bareHostRegex.MatchString(tok)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeCountry(t *testing.T) {
+	for in, want := range map[string]string{"de": "DE", " us ": "US", "UK": "GB"} {
+		got, ok := normalizeCountry(in)
+		assert.True(t, ok, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "ZZ", "germany", "d1", "EU"} {
+		_, ok := normalizeCountry(in)
+		assert.False(t, ok, in)
+	}
+}
+
+func TestCommandInputCountry(t *testing.T) {
+	country := func(flags map[string]string) (string, bool) {
+		return commandInput{Flags: flags}.country()
+	}
+	code, ok := country(map[string]string{})
+	assert.True(t, ok)
+	assert.Empty(t, code)
+
+	code, ok = country(map[string]string{"country": "uk"})
+	assert.True(t, ok)
+	assert.Equal(t, "GB", code)
+
+	_, ok = country(map[string]string{"country": "ZZ"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Interactive dialog ----
+
+const (
+	pluginID          = "com.mattermost.songlink"
+	dialogCallbackID  = "songlink_preview"
+	maxCaptionLength  = 1000
+	dialogSubmitRoute = "/plugins/" + pluginID + "/api/v1/dialog"
+)
+
+// openPreviewDialog shows the "Create preview" form when the command is run
+// without arguments.
+func (p *Plugin) openPreviewDialog(args *model.CommandArgs) *model.CommandResponse {
+	locale := p.userLocale(args.UserId)
+	req := model.OpenDialogRequest{
+		TriggerId: args.TriggerId,
+		URL:       dialogSubmitRoute,
+		Dialog: model.Dialog{
+			CallbackId: dialogCallbackID,
+			// Carry the thread through so the preview lands where the
+			// command was run.
+			State:       args.RootId,
+			Title:       tr(locale, "dialog_title"),
+			SubmitLabel: tr(locale, "dialog_submit"),
+			Elements: []model.DialogElement{
+				{
+					DisplayName: tr(locale, "dialog_url"),
+					Name:        "url",
+					Type:        "text",
+					SubType:     "url",
+					Placeholder: "https://open.spotify.com/track/…",
+					HelpText:    tr(locale, "dialog_url_help"),
+				},
+				{
+					DisplayName: tr(locale, "dialog_caption"),
+					Name:        "caption",
+					Type:        "textarea",
+					Optional:    true,
+					MaxLength:   maxCaptionLength,
+				},
+			},
+		},
+	}
+	if appErr := p.API.OpenInteractiveDialog(req); appErr != nil {
+		p.API.LogError("failed to open preview dialog", "err", appErr.Error())
+		return p.textResponse(p.config().usage(locale))
+	}
+	return &model.CommandResponse{}
+}
+
+func (p *Plugin) handleDialogSubmit(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+
+	var req model.SubmitDialogRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid dialog submission")
+		return
+	}
+	if req.UserId != userID || req.CallbackId != dialogCallbackID {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if req.Cancelled {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rawURL, _ := req.Submission["url"].(string)
+	caption, _ := req.Submission["caption"].(string)
+	rawURL, caption = strings.TrimSpace(rawURL), strings.TrimSpace(caption)
+
+	locale := p.userLocale(userID)
+	errs := map[string]string{}
+	switch {
+	case rawURL == "":
+		errs["url"] = tr(locale, "dialog_url_missing")
+	case !isURLToken(rawURL):
+		errs["url"] = tr(locale, "dialog_url_invalid")
+	}
+	if utf8.RuneCountInString(caption) > maxCaptionLength {
+		errs["caption"] = tr(locale, "dialog_caption_too_long")
+	}
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Errors: errs})
+		return
+	}
+
+	prefs := p.userPrefs(userID)
+	private := prefs.Visibility == visibilityPrivate
+	if !private {
+		if refusal := p.postRefusal(userID, req.ChannelId); refusal != "" {
+			writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Error: tr(locale, refusal)})
+			return
+		}
+	}
+	if refusal := p.previewRefusal(userID, req.TeamId); refusal != "" {
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Error: tr(locale, refusal)})
+		return
+	}
+
+	preview := previewRequest{
+		UserID:    userID,
+		TeamID:    req.TeamId,
+		ChannelID: req.ChannelId,
+		RootID:    req.State,
+		URLs:      []string{cleanMusicURL(rawURL)},
+		Caption:   caption,
+		Country:   prefs.Country,
+		Private:   private,
+	}
+	if !p.submit(func() { p.postPreview(preview) }) {
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Error: tr(locale, "busy")})
+		return
+	}
+	writeJSON(w, http.StatusOK, model.SubmitDialogResponse{})
+}
+
+// ---- Share button on private previews ----
+
+const (
+	shareActionID = "share"
+	shareRoute    = "/plugins/" + pluginID + "/api/v1/share"
+)
+
+func shareAction(req previewRequest, locale string) *model.PostAction {
+	return &model.PostAction{
+		Id:   shareActionID,
+		Name: tr(locale, "share_button"),
+		Type: model.PostActionTypeButton,
+		Integration: &model.PostActionIntegration{
+			URL: shareRoute,
+			Context: map[string]any{
+				"urls":    req.URLs,
+				"caption": req.Caption,
+				"root_id": req.RootID,
+				"country": req.Country,
+				"compact": req.Compact,
+			},
+		},
+	}
+}
+
+// handleShare posts a private preview publicly when its button is clicked.
+func (p *Plugin) handleShare(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid action request")
+		return
+	}
+	urls := contextStrings(req.Context["urls"])
+	caption, _ := req.Context["caption"].(string)
+	rootID, _ := req.Context["root_id"].(string)
+	country, _ := req.Context["country"].(string)
+	country, _ = normalizeCountry(country)
+	compact, _ := req.Context["compact"].(bool)
+	if req.UserId != userID || len(urls) == 0 || len(urls) > maxPreviewURLs {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if refusal := p.postRefusal(userID, req.ChannelId); refusal != "" {
+		writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{
+			EphemeralText: tr(p.userLocale(userID), refusal),
+		})
+		return
+	}
+	if refusal := p.previewRefusal(userID, req.TeamId); refusal != "" {
+		writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{EphemeralText: tr(p.userLocale(userID), refusal)})
+		return
+	}
+
+	preview := previewRequest{
+		UserID:    userID,
+		TeamID:    req.TeamId,
+		ChannelID: req.ChannelId,
+		RootID:    rootID,
+		URLs:      urls,
+		Caption:   caption,
+		Country:   country,
+		Compact:   compact,
+	}
+	if !p.submit(func() { p.postPreview(preview) }) {
+		writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{EphemeralText: tr(p.userLocale(userID), "busy")})
+		return
+	}
+	writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{})
+}
+
+// contextStrings reads a string list from action context, where it arrives
+// as []any after the JSON round trip.
+func contextStrings(v any) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []any:
+		var out []string
+		for _, item := range list {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callAction sends body to handler as userID.
+func callAction(handler http.HandlerFunc, userID string, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data)))
+	r.Header.Set("Mattermost-User-Id", userID)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func newRestrictedPlugin(t *testing.T, cfg *Config) *Plugin {
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+	api.On("HasPermissionTo", "user1", model.PermissionManageSystem).Return(false).Maybe()
+	recordPosts(api)
+	return newTestPlugin(t, api, cfg)
+}
+
+func TestDialogSubmitRestrictions(t *testing.T) {
+	submit := model.SubmitDialogRequest{
+		UserId:     "user1",
+		ChannelId:  "channel1",
+		TeamId:     "team1",
+		CallbackId: dialogCallbackID,
+		Submission: map[string]any{"url": "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"},
+	}
+
+	t.Run("system admins only", func(t *testing.T) {
+		p := newRestrictedPlugin(t, &Config{RestrictToSystemAdmins: true})
+		var resp model.SubmitDialogResponse
+		require.NoError(t, json.Unmarshal(callAction(p.handleDialogSubmit, "user1", submit).Body.Bytes(), &resp))
+		assert.Equal(t, tr("en", "not_permitted"), resp.Error)
+	})
+
+	t.Run("team not allowed", func(t *testing.T) {
+		p := newRestrictedPlugin(t, &Config{AllowedTeamIDs: "team2"})
+		var resp model.SubmitDialogResponse
+		require.NoError(t, json.Unmarshal(callAction(p.handleDialogSubmit, "user1", submit).Body.Bytes(), &resp))
+		assert.Equal(t, tr("en", "not_permitted"), resp.Error)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		p := newRestrictedPlugin(t, &Config{CommandsPerMinute: 1})
+		var resp model.SubmitDialogResponse
+		require.NoError(t, json.Unmarshal(callAction(p.handleDialogSubmit, "user1", submit).Body.Bytes(), &resp))
+		assert.Empty(t, resp.Error)
+		require.NoError(t, json.Unmarshal(callAction(p.handleDialogSubmit, "user1", submit).Body.Bytes(), &resp))
+		assert.Equal(t, tr("en", "too_fast"), resp.Error)
+		waitForWork(t, p)
+	})
+}
+
+func TestShareRestrictions(t *testing.T) {
+	share := model.PostActionIntegrationRequest{
+		UserId:    "user1",
+		ChannelId: "channel1",
+		TeamId:    "team1",
+		Context:   map[string]any{"urls": []string{"https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"}},
+	}
+
+	t.Run("system admins only", func(t *testing.T) {
+		p := newRestrictedPlugin(t, &Config{RestrictToSystemAdmins: true})
+		var resp model.PostActionIntegrationResponse
+		require.NoError(t, json.Unmarshal(callAction(p.handleShare, "user1", share).Body.Bytes(), &resp))
+		assert.Equal(t, tr("en", "not_permitted"), resp.EphemeralText)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		p := newRestrictedPlugin(t, &Config{CommandsPerMinute: 1})
+		var resp model.PostActionIntegrationResponse
+		require.NoError(t, json.Unmarshal(callAction(p.handleShare, "user1", share).Body.Bytes(), &resp))
+		assert.Empty(t, resp.EphemeralText)
+		require.NoError(t, json.Unmarshal(callAction(p.handleShare, "user1", share).Body.Bytes(), &resp))
+		assert.Equal(t, tr("en", "too_fast"), resp.EphemeralText)
+		waitForWork(t, p)
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+)
+
+// ---- Digest mode ----
+//
+// In channels busier than DigestThreshold messages per minute, music links
+// are queued in KV instead of unfurled one by one, and a cluster-wide job
+// posts a single "recently shared" card per channel every interval.
+
+const (
+	digestJobKey          = "digest_flush"
+	digestChannelsKey     = "digest_channels"
+	digestPendingPrefix   = "digest_pending_"
+	maxDigestLinks        = 20
+	minDigestInterval     = time.Minute
+	defaultDigestInterval = 10 * time.Minute
+	maxTrackedChannels    = 10000
+)
+
+type pendingLink struct {
+	URL    string `json:"url"`
+	PostID string `json:"post_id"`
+}
+
+func (c *Config) digestEnabled() bool {
+	return c != nil && c.DigestThreshold > 0
+}
+
+func (c *Config) digestInterval() time.Duration {
+	d := defaultDigestInterval
+	if c != nil && c.DigestIntervalMinutes > 0 {
+		d = time.Duration(c.DigestIntervalMinutes) * time.Minute
+	}
+	if d < minDigestInterval {
+		d = minDigestInterval
+	}
+	return d
+}
+
+// channelRates estimates messages per minute per channel with a two-bucket
+// sliding window. Counts are per node, which is fine for a noise threshold.
+type channelRates struct {
+	mu      sync.Mutex
+	buckets map[string]rateBucket
+}
+
+type rateBucket struct {
+	minute      int64
+	count, prev int
+}
+
+func newChannelRates() *channelRates {
+	return &channelRates{buckets: map[string]rateBucket{}}
+}
+
+// hit records a message in channelID and returns the estimated rate.
+func (r *channelRates) hit(channelID string, now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	minute := now.Unix() / 60
+	b := r.buckets[channelID]
+	switch b.minute {
+	case minute:
+		b.count++
+	case minute - 1:
+		b = rateBucket{minute: minute, count: 1, prev: b.count}
+	default:
+		b = rateBucket{minute: minute, count: 1}
+	}
+	r.buckets[channelID] = b
+
+	if len(r.buckets) > maxTrackedChannels {
+		for id, old := range r.buckets {
+			if old.minute < minute-1 {
+				delete(r.buckets, id)
+			}
+		}
+	}
+
+	return b.rate(now)
+}
+
+// rate returns channelID's estimated rate without counting a message.
+func (r *channelRates) rate(channelID string, now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.buckets[channelID]
+	switch minute := now.Unix() / 60; b.minute {
+	case minute:
+	case minute - 1:
+		b = rateBucket{minute: minute, prev: b.count}
+	default:
+		return 0
+	}
+	return b.rate(now)
+}
+
+func (b rateBucket) rate(now time.Time) float64 {
+	elapsed := float64(now.Unix()%60) / 60
+	return float64(b.prev)*(1-elapsed) + float64(b.count)
+}
+
+// queueForDigest parks urls for the next digest of post's channel.
+func (p *Plugin) queueForDigest(post *model.Post, urls []string) {
+	_, err := kvUpdateJSON(p.API, digestPendingPrefix+post.ChannelId, func(links *[]pendingLink) bool {
+		changed := false
+		for _, u := range urls {
+			if len(*links) >= maxDigestLinks || containsLink(*links, u) {
+				continue
+			}
+			*links = append(*links, pendingLink{URL: u, PostID: post.Id})
+			changed = true
+		}
+		return changed
+	})
+	if err != nil {
+		p.logWarn("failed to queue link for digest", "err", err.Error())
+		return
+	}
+	// Register the channel after the links so a concurrent flush can't drop
+	// them (see flushDigests).
+	if _, err := kvUpdateJSON(p.API, digestChannelsKey, func(ids *[]string) bool {
+		for _, id := range *ids {
+			if id == post.ChannelId {
+				return false
+			}
+		}
+		*ids = append(*ids, post.ChannelId)
+		return true
+	}); err != nil {
+		p.logWarn("failed to register digest channel", "err", err.Error())
+	}
+}
+
+// scheduleDigest (re)starts the flush job to match the current config. It is
+// a no-op until the plugin has activated.
+func (p *Plugin) scheduleDigest() {
+	if !p.active() {
+		// OnActivate schedules it once the plugin is running.
+		return
+	}
+	if p.digestJob != nil {
+		if err := p.digestJob.Close(); err != nil {
+			p.logWarn("failed to stop digest job", "err", err.Error())
+		}
+		p.digestJob = nil
+	}
+	// Keep flushing after digests are switched off so nothing queued is lost;
+	// the job is cheap when there is nothing to do.
+	job, err := cluster.Schedule(p.API, digestJobKey, cluster.MakeWaitForInterval(p.config().digestInterval()), p.flushDigests)
+	if err != nil {
+		p.API.LogError("failed to schedule digest job", "err", err.Error())
+		return
+	}
+	p.digestJob = job
+}
+
+func (p *Plugin) flushDigests() {
+	data, appErr := p.API.KVGet(digestChannelsKey)
+	if appErr != nil || data == nil {
+		return
+	}
+	var channels []string
+	if err := json.Unmarshal(data, &channels); err != nil || len(channels) == 0 {
+		return
+	}
+	// Unregister first: a link queued from here on re-registers its channel,
+	// so it is picked up by the next run at the latest.
+	if ok, appErr := p.API.KVCompareAndDelete(digestChannelsKey, data); appErr != nil || !ok {
+		return
+	}
+
+	for _, channelID := range channels {
+		key := digestPendingPrefix + channelID
+		raw, appErr := p.API.KVGet(key)
+		if appErr != nil || raw == nil {
+			continue
+		}
+		if ok, appErr := p.API.KVCompareAndDelete(key, raw); appErr != nil || !ok {
+			continue
+		}
+		var links []pendingLink
+		if err := json.Unmarshal(raw, &links); err != nil {
+			continue
+		}
+		p.postDigest(channelID, links)
+	}
+}
+
+func (p *Plugin) postDigest(channelID string, links []pendingLink) {
+	var lines []string
+	for _, l := range links {
+		att, _, err := p.lookupOdesli(l.URL, p.config().country())
+		if err != nil || att == nil || att.TitleLink == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("• [%s](%s)", escapeLinkText(att.Title), att.TitleLink))
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	post := &model.Post{
+		ChannelId: channelID,
+		Props: map[string]any{
+			"attachments": []*model.SlackAttachment{{
+				Fallback: tr(p.serverLocale(), "digest_fallback", len(lines)),
+				Title:    tr(p.serverLocale(), "digest_title"),
+				Text:     strings.Join(lines, "\n"),
+			}},
+		},
+	}
+	if _, err := p.createBotPost(post); err != nil {
+		p.logWarn("failed to post digest", "err", err.Error())
+	}
+}
+
+func containsLink(links []pendingLink, u string) bool {
+	for _, l := range links {
+		if l.URL == u {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Explicit content ----
+//
+// Odesli doesn't say whether a track is explicit; today only Spotify
+// enrichment does. When explicitness is unknown the track is treated as clean
+// in every mode.
+
+const (
+	explicitIgnore = "ignore"
+	explicitBadge  = "badge"
+	explicitBlock  = "block"
+
+	explicitBadgeText = " [Explicit]"
+)
+
+var errExplicitBlocked = errors.New("explicit track blocked by configuration")
+
+// applyExplicitPolicy badges or rejects a known-explicit track according to
+// ExplicitContent.
+func applyExplicitPolicy(att *model.SlackAttachment, track *spotifyTrack, cfg *Config) error {
+	if track == nil || !track.Explicit || cfg == nil {
+		return nil
+	}
+	switch cfg.ExplicitContent {
+	case explicitBlock:
+		return errExplicitBlocked
+	case explicitBadge:
+		att.Title += explicitBadgeText
+		att.Fallback += explicitBadgeText
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyExplicitPolicy(t *testing.T) {
+	explicit, clean := &spotifyTrack{Explicit: true}, &spotifyTrack{}
+	for _, tc := range []struct {
+		name      string
+		mode      string
+		track     *spotifyTrack
+		wantTitle string
+		wantErr   error
+	}{
+		{"ignore", explicitIgnore, explicit, "Song", nil},
+		{"unset", "", explicit, "Song", nil},
+		{"badge", explicitBadge, explicit, "Song [Explicit]", nil},
+		{"block", explicitBlock, explicit, "Song", errExplicitBlocked},
+		{"badge, clean track", explicitBadge, clean, "Song", nil},
+		{"block, clean track", explicitBlock, clean, "Song", nil},
+		// Without Spotify enrichment nobody knows; treat it as clean.
+		{"badge, unknown", explicitBadge, nil, "Song", nil},
+		{"block, unknown", explicitBlock, nil, "Song", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			att := &model.SlackAttachment{Title: "Song", Fallback: "Song"}
+			err := applyExplicitPolicy(att, tc.track, &Config{ExplicitContent: tc.mode})
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantTitle, att.Title)
+			assert.Equal(t, tc.wantTitle, att.Fallback)
+		})
+	}
+}
+
+func TestExplicitBlockedMessage(t *testing.T) {
+	p := &Plugin{}
+	assert.Equal(t, tr("de", "explicit_blocked"), p.failureMessage("de", errExplicitBlocked))
+}
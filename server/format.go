@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/unicode/bidi"
+)
+
+// ---- Metadata formatting ----
+//
+// Attachments are stored once and rendered identically for every viewer, so
+// there is no way to format per viewing user. All metadata is formatted with
+// the server's default locale instead; keep every number/date that ends up in
+// a card going through these helpers so it stays consistent.
+
+const defaultLocale = "en"
+
+// dateLayouts maps a base language to a numeric-first date layout. Month-name
+// layouts are only used for English since time.Format cannot localize them.
+var dateLayouts = map[string]string{
+	"en": "2 Jan 2006",
+	"de": "2.1.2006",
+	"nl": "2-1-2006",
+	"fr": "02/01/2006",
+	"es": "02/01/2006",
+	"it": "02/01/2006",
+	"pt": "02/01/2006",
+	"pl": "02.01.2006",
+	"ru": "02.01.2006",
+	"ja": "2006/01/02",
+	"zh": "2006/01/02",
+	"ko": "2006. 1. 2.",
+}
+
+// serverLocale returns the server's default locale, falling back to English.
+func (p *Plugin) serverLocale() string {
+	if p.API == nil {
+		return defaultLocale
+	}
+	cfg := p.API.GetConfig()
+	if cfg == nil || cfg.LocalizationSettings.DefaultServerLocale == nil {
+		return defaultLocale
+	}
+	if l := strings.TrimSpace(*cfg.LocalizationSettings.DefaultServerLocale); l != "" {
+		return l
+	}
+	return defaultLocale
+}
+
+// formatNumber renders n with the digit grouping of locale (1,234 vs 1.234).
+func formatNumber(locale string, n int64) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.English
+	}
+	return message.NewPrinter(tag).Sprintf("%d", n)
+}
+
+// formatDate renders t as a date-only string in locale's usual order.
+func formatDate(locale string, t time.Time) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return t.Format("2006-01-02")
+	}
+	if tag == language.AmericanEnglish {
+		return t.Format("Jan 2, 2006")
+	}
+	base, _ := tag.Base()
+	if layout, ok := dateLayouts[base.String()]; ok {
+		return t.Format(layout)
+	}
+	return t.Format("2006-01-02")
+}
+
+// formatDuration renders d as m:ss or h:mm:ss. Clock notation reads the same
+// in every locale we support.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	secs := int64(d.Round(time.Second) / time.Second)
+	h, m, s := secs/3600, (secs%3600)/60, secs%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// headingSep sits between the parts of a card heading ("Artist — Title").
+const headingSep = " — "
+
+// Unicode first-strong isolate and pop directional isolate.
+const (
+	bidiIsolate = "\u2068"
+	bidiPop     = "\u2069"
+)
+
+// joinHeading joins the non-empty parts with headingSep. Parts in a
+// right-to-left script are wrapped in directional isolates, so an Arabic
+// artist next to a Latin title keeps the dash between them.
+func joinHeading(parts ...string) string {
+	kept := make([]string, 0, len(parts))
+	for _, s := range parts {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if hasRTL(s) {
+			s = bidiIsolate + s + bidiPop
+		}
+		kept = append(kept, s)
+	}
+	return strings.Join(kept, headingSep)
+}
+
+// linkTextEscaper backslash-escapes what Markdown would otherwise read as
+// formatting or the end of a link's text.
+var linkTextEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`,
+	"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "|", `\|`,
+	"\r\n", " ", "\n", " ", "\r", " ",
+)
+
+// escapeLinkText makes a title safe as the text of a Markdown link, so a
+// name like "[Live]" or "*NSYNC" shows as written and keeps the link intact.
+func escapeLinkText(s string) string {
+	return linkTextEscaper.Replace(s)
+}
+
+// hasRTL reports whether s contains right-to-left letters (Hebrew, Arabic,
+// …).
+func hasRTL(s string) bool {
+	for _, r := range s {
+		if p, _ := bidi.LookupRune(r); p.Class() == bidi.R || p.Class() == bidi.AL {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatNumber(t *testing.T) {
+	assert.Equal(t, "1,234,567", formatNumber("en", 1234567))
+	assert.Equal(t, "1.234.567", formatNumber("de", 1234567))
+	assert.Equal(t, "42", formatNumber("de", 42))
+	assert.Equal(t, "1,234", formatNumber("not a locale", 1234))
+}
+
+func TestFormatDate(t *testing.T) {
+	d := time.Date(2001, time.March, 7, 0, 0, 0, 0, time.UTC)
+	for locale, want := range map[string]string{
+		"en":           "7 Mar 2001",
+		"en-US":        "Mar 7, 2001",
+		"de":           "7.3.2001",
+		"ja":           "2001/03/07",
+		"sv":           "2001-03-07",
+		"not a locale": "2001-03-07",
+	} {
+		assert.Equal(t, want, formatDate(locale, d), locale)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "0:00", formatDuration(-time.Second))
+	assert.Equal(t, "5:20", formatDuration(320*time.Second+400*time.Millisecond))
+	assert.Equal(t, "1:02:03", formatDuration(time.Hour+2*time.Minute+3*time.Second))
+}
+
+func TestJoinHeading(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		parts []string
+		want  string
+	}{
+		{"both", []string{"Daft Punk", "One More Time"}, "Daft Punk — One More Time"},
+		{"empty artist", []string{"", "One More Time"}, "One More Time"},
+		{"empty title", []string{"Daft Punk", " "}, "Daft Punk"},
+		{"nothing", []string{"", ""}, ""},
+		{"non-Latin", []string{"Björk", "Jóga"}, "Björk — Jóga"},
+		{"CJK", []string{"宇多田ヒカル", "First Love"}, "宇多田ヒカル — First Love"},
+		{"RTL artist", []string{"فيروز", "Kifak Inta"}, bidiIsolate + "فيروز" + bidiPop + " — Kifak Inta"},
+		{"RTL both", []string{"עומר אדם", "שיר"}, bidiIsolate + "עומר אדם" + bidiPop + " — " + bidiIsolate + "שיר" + bidiPop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := joinHeading(tc.parts...)
+			assert.Equal(t, tc.want, got)
+			assert.False(t, strings.HasPrefix(got, "—") || strings.HasSuffix(got, "—"), "dangling dash")
+		})
+	}
+}
+
+func TestEscapeLinkText(t *testing.T) {
+	for in, want := range map[string]string{
+		"One More Time":          "One More Time",
+		"*NSYNC":                 `\*NSYNC`,
+		"Song [Live] (2004)":     `Song \[Live\] (2004)`,
+		"snake_case_beats":       `snake\_case\_beats`,
+		"a `b` ~c~ <d> | e \\ f": "a \\`b\\` \\~c\\~ \\<d\\> \\| e \\\\ f",
+		"two\nlines\r\nhere":     "two lines here",
+	} {
+		assert.Equal(t, want, escapeLinkText(in), in)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// ---- Message catalog ----
+//
+// Replies meant for one user (ephemeral posts, command responses, dialog
+// errors) follow that user's language setting. Text that ends up in a
+// shared post uses the server's default locale, like the card metadata in
+// format.go. Missing translations fall back to English.
+
+// messages holds the user-facing strings by base language and id. Entries
+// are fmt formats; their verbs must match the English original.
+var messages = map[string]map[string]string{
+	"en": {
+		"usage":                     "Usage: /%[1]s [--private|--public] <music-url>, or /%[1]s help",
+		"not_permitted":             "You’re not permitted to use this command here.",
+		"too_many_links":            "That’s a lot of links: at most %d at a time, please.",
+		"bad_country_flag":          "`--country` needs a two-letter country code, e.g. `--country=DE`.",
+		"cannot_post":               "You don’t have permission to post in this channel.",
+		"bot_cannot_post":           "Songlink can’t post in this channel. Ask a channel admin to add it, or use `--private` to see the preview just for yourself.",
+		"too_fast":                  "You’re creating previews too quickly. Please wait a moment and try again.",
+		"busy":                      "Songlink is busy right now. Please try again in a moment.",
+		"fetching":                  "Fetching preview…",
+		"lookup_failed":             "Couldn’t fetch details for that link.",
+		"no_details":                "Odesli doesn’t know anything about that link yet, so there’s nothing to preview.",
+		"explicit_blocked":          "That track is marked explicit and can’t be posted here.",
+		"lookup_timeout":            "Looking up that link took too long, please try again.",
+		"odesli_busy":               "Music service is busy, please try again in a moment.",
+		"odesli_busy_wait":          "Music service is busy, please try again in %s.",
+		"odesli_unavailable":        "Music service is unavailable right now, please try again later.",
+		"partial_failures":          "_%d of %d links couldn’t be previewed._",
+		"post_failed":               "Failed to post preview.",
+		"posted_privately":          "_Songlink couldn’t post in this channel, so only you can see this preview._",
+		"posted_confirmation":       "Your preview was posted. [Jump to it](%s)",
+		"visibility_status_public":  "Your previews are public by default. Change it with `/%s visibility public|private`.",
+		"visibility_status_private": "Your previews are private by default. Change it with `/%s visibility public|private`.",
+		"visibility_usage":          "Usage: /%s visibility public|private",
+		"visibility_public":         "Your previews will now be posted to the channel.",
+		"visibility_private":        "Your previews will now be visible only to you, with a button to share them.",
+		"save_failed":               "Couldn’t save your preference, please try again.",
+		"country_usage":             "Usage: /%s setcountry XX|clear, with a two-letter country code such as DE.",
+		"country_status":            "Your country is set to %s. %s",
+		"country_cleared":           "Your country preference was cleared.",
+		"country_set":               "Links you share will now be looked up for %s.",
+		"unfurl_status_on":          "Auto-unfurl is on in this channel. Change it with `/%s unfurl on|off`.",
+		"unfurl_status_off":         "Auto-unfurl is off in this channel. Change it with `/%s unfurl on|off`.",
+		"unfurl_usage":              "Usage: /%s unfurl on|off",
+		"unfurl_forbidden":          "Only channel admins can change auto-unfurl for this channel.",
+		"unfurl_save_failed":        "Couldn’t save the channel setting, please try again.",
+		"unfurl_on":                 "Music links posted in this channel will now be unfurled.",
+		"unfurl_off":                "Music links posted in this channel will no longer be unfurled.",
+		"stats_user":                "You’ve previewed %[1]d links, %[2]d of them successfully.",
+		"stats_total":               "Everyone together has previewed %[1]d links, %[2]d of them successfully.",
+		"stats_forbidden":           "Only system admins can see the totals for everyone.",
+		"stats_failed":              "Couldn’t load the stats, please try again.",
+		"thread_usage":              "Run `/%s thread` from a thread’s reply box to preview the music links shared in it.",
+		"thread_no_links":           "No music links have been shared in this thread yet.",
+		"thread_failed":             "Couldn’t read this thread, please try again.",
+		"no_music_link":             "That post doesn’t contain a music link.",
+		"dialog_title":              "Create preview",
+		"dialog_submit":             "Post",
+		"dialog_url":                "Music link",
+		"dialog_url_help":           "A link from Spotify, Apple Music, YouTube Music, TIDAL, etc.",
+		"dialog_caption":            "Caption",
+		"dialog_url_missing":        "Enter a music link.",
+		"dialog_url_invalid":        "That doesn’t look like a link, e.g. https://open.spotify.com/track/…",
+		"dialog_caption_too_long":   "Caption is too long.",
+		"share_button":              "Share to channel",
+		"remove_button":             "Remove preview",
+		"remove_forbidden":          "Only the person who shared the link or a channel admin can remove this preview.",
+		"remove_failed":             "Couldn’t remove the preview.",
+		"test_forbidden":            "Only system admins can run the connectivity test.",
+		"help_post":                 "- `/%s <music-url>` posts a preview with links to every platform. Words around the link become the caption.",
+		"help_form":                 "- `/%s` on its own opens a form for the link and caption.",
+		"help_private":              "- `--private` (or `--preview`) shows the preview only to you, with a button to share it; `--public` posts it even if your default is private.",
+		"help_preview":              "- `/%s preview <music-url>` is the same as `--preview`.",
+		"help_country":              "- `--country=XX` looks the link up for another country (two-letter code, e.g. `--country=DE`).",
+		"help_compact":              "- `--compact` shows just the title and platform links, without thumbnail or details.",
+		"help_thread":               "- `/%s thread`, run in a thread, previews the music links shared in it together in one post.",
+		"help_setcountry":           "- `/%[1]s setcountry XX` remembers your country for your previews and pasted links; `/%[1]s setcountry clear` forgets it.",
+		"help_visibility":           "- `/%s visibility public|private` sets your default.",
+		"help_unfurl":               "- `/%s unfurl on|off` turns automatic previews on or off for this channel (channel admins).",
+		"help_stats":                "- `/%s stats` shows how many links you've previewed; `--all` shows the totals for everyone (system admins).",
+		"help_cache":                "- `/%s cache clear|stats` empties the lookup cache or shows its size and hit rate (system admins).",
+		"help_test":                 "- `/%s test [music-url]` checks the connection to Odesli without posting (system admins).",
+		"help_help":                 "- `/%s help` shows this message.",
+		"help_platforms":            "Platforms: %s",
+		"cache_forbidden":           "Only system admins can manage the lookup cache.",
+		"cache_usage":               "Usage: /%s cache clear|stats",
+		"cache_cleared":             "Cleared %d cached lookups.",
+		"cache_stats":               "#### Songlink lookup cache\n- Entries: %d of %d\n- Hits: %d, misses: %d\n- Hit rate: %s",
+		"cache_rate_none":           "n/a",
+		"chip_songlink":             "Open on Songlink",
+		"chip_more":                 "+%d more",
+		"all_links":                 "All links",
+		"shared_from":               "Shared from %s",
+		"digest_title":              "Recently shared music",
+		"digest_fallback":           "Recently shared music (%d)",
+		"thread_summary_title":      "Thread playlist",
+		"thread_summary_fallback":   "Thread playlist (%d tracks)",
+		"thread_summary_more":       "…and %d more",
+	},
+	"de": {
+		"usage":                     "Verwendung: /%[1]s [--private|--public] <Musik-URL> oder /%[1]s help",
+		"not_permitted":             "Du darfst diesen Befehl hier nicht verwenden.",
+		"too_many_links":            "Das sind viele Links: bitte höchstens %d auf einmal.",
+		"bad_country_flag":          "`--country` braucht einen zweistelligen Ländercode, z. B. `--country=DE`.",
+		"cannot_post":               "Du darfst in diesem Kanal nichts posten.",
+		"bot_cannot_post":           "Songlink kann in diesem Kanal nicht posten. Bitte einen Kanal-Admin, es hinzuzufügen, oder verwende `--private`, um die Vorschau nur für dich zu sehen.",
+		"too_fast":                  "Du erstellst Vorschauen zu schnell. Bitte warte einen Moment und versuche es erneut.",
+		"busy":                      "Songlink ist gerade ausgelastet. Bitte versuche es gleich noch einmal.",
+		"fetching":                  "Vorschau wird geladen…",
+		"lookup_failed":             "Zu diesem Link konnten keine Details abgerufen werden.",
+		"no_details":                "Odesli kennt diesen Link noch nicht, daher gibt es nichts für eine Vorschau.",
+		"explicit_blocked":          "Dieser Titel ist als explizit markiert und kann hier nicht gepostet werden.",
+		"lookup_timeout":            "Das Nachschlagen des Links hat zu lange gedauert, bitte versuche es erneut.",
+		"odesli_busy":               "Der Musikdienst ist ausgelastet, bitte versuche es gleich noch einmal.",
+		"odesli_busy_wait":          "Der Musikdienst ist ausgelastet, bitte versuche es in %s erneut.",
+		"odesli_unavailable":        "Der Musikdienst ist gerade nicht erreichbar, bitte versuche es später erneut.",
+		"partial_failures":          "_Für %d von %d Links konnte keine Vorschau erstellt werden._",
+		"post_failed":               "Die Vorschau konnte nicht gepostet werden.",
+		"posted_privately":          "_Songlink konnte in diesem Kanal nicht posten, daher siehst nur du diese Vorschau._",
+		"posted_confirmation":       "Deine Vorschau wurde gepostet. [Zur Vorschau springen](%s)",
+		"visibility_status_public":  "Deine Vorschauen sind standardmäßig öffentlich. Ändern mit `/%s visibility public|private`.",
+		"visibility_status_private": "Deine Vorschauen sind standardmäßig privat. Ändern mit `/%s visibility public|private`.",
+		"visibility_usage":          "Verwendung: /%s visibility public|private",
+		"visibility_public":         "Deine Vorschauen werden jetzt im Kanal gepostet.",
+		"visibility_private":        "Deine Vorschauen sind jetzt nur für dich sichtbar, mit einem Button zum Teilen.",
+		"save_failed":               "Deine Einstellung konnte nicht gespeichert werden, bitte versuche es erneut.",
+		"country_usage":             "Verwendung: /%s setcountry XX|clear, mit einem zweistelligen Ländercode wie DE.",
+		"country_status":            "Dein Land ist auf %s gesetzt. %s",
+		"country_cleared":           "Deine Ländereinstellung wurde entfernt.",
+		"country_set":               "Links, die du teilst, werden jetzt für %s nachgeschlagen.",
+		"unfurl_status_on":          "Automatische Vorschauen sind in diesem Kanal an. Ändern mit `/%s unfurl on|off`.",
+		"unfurl_status_off":         "Automatische Vorschauen sind in diesem Kanal aus. Ändern mit `/%s unfurl on|off`.",
+		"unfurl_usage":              "Verwendung: /%s unfurl on|off",
+		"unfurl_forbidden":          "Nur Kanal-Admins können automatische Vorschauen für diesen Kanal ändern.",
+		"unfurl_save_failed":        "Die Kanaleinstellung konnte nicht gespeichert werden, bitte versuche es erneut.",
+		"unfurl_on":                 "Für Musiklinks in diesem Kanal werden jetzt Vorschauen erstellt.",
+		"unfurl_off":                "Für Musiklinks in diesem Kanal werden keine Vorschauen mehr erstellt.",
+		"stats_user":                "Du hast für %[1]d Links eine Vorschau angefordert, %[2]d davon erfolgreich.",
+		"stats_total":               "Insgesamt wurde für %[1]d Links eine Vorschau angefordert, %[2]d davon erfolgreich.",
+		"stats_forbidden":           "Nur System-Admins können die Gesamtzahlen sehen.",
+		"stats_failed":              "Die Statistik konnte nicht geladen werden, bitte versuche es erneut.",
+		"thread_usage":              "Führe `/%s thread` im Antwortfeld eines Threads aus, um eine Vorschau der dort geteilten Musiklinks zu erhalten.",
+		"thread_no_links":           "In diesem Thread wurden noch keine Musiklinks geteilt.",
+		"thread_failed":             "Dieser Thread konnte nicht gelesen werden, bitte versuche es erneut.",
+		"no_music_link":             "Dieser Beitrag enthält keinen Musiklink.",
+		"dialog_title":              "Vorschau erstellen",
+		"dialog_submit":             "Posten",
+		"dialog_url":                "Musiklink",
+		"dialog_url_help":           "Ein Link von Spotify, Apple Music, YouTube Music, TIDAL usw.",
+		"dialog_caption":            "Beschriftung",
+		"dialog_url_missing":        "Gib einen Musiklink ein.",
+		"dialog_url_invalid":        "Das sieht nicht nach einem Link aus, z. B. https://open.spotify.com/track/…",
+		"dialog_caption_too_long":   "Die Beschriftung ist zu lang.",
+		"share_button":              "Im Kanal teilen",
+		"remove_button":             "Vorschau entfernen",
+		"remove_forbidden":          "Nur die Person, die den Link geteilt hat, oder ein Kanal-Admin kann diese Vorschau entfernen.",
+		"remove_failed":             "Die Vorschau konnte nicht entfernt werden.",
+		"test_forbidden":            "Nur System-Admins können den Verbindungstest ausführen.",
+		"help_post":                 "- `/%s <Musik-URL>` postet eine Vorschau mit Links zu allen Plattformen. Worte um den Link herum werden zur Beschriftung.",
+		"help_form":                 "- `/%s` allein öffnet ein Formular für Link und Beschriftung.",
+		"help_private":              "- `--private` (oder `--preview`) zeigt die Vorschau nur dir, mit einem Button zum Teilen; `--public` postet sie auch dann, wenn deine Standardeinstellung privat ist.",
+		"help_preview":              "- `/%s preview <Musik-URL>` entspricht `--preview`.",
+		"help_country":              "- `--country=XX` schlägt den Link für ein anderes Land nach (zweistelliger Code, z. B. `--country=DE`).",
+		"help_compact":              "- `--compact` zeigt nur Titel und Plattform-Links, ohne Vorschaubild und Details.",
+		"help_thread":               "- `/%s thread` in einem Thread erstellt eine gemeinsame Vorschau der dort geteilten Musiklinks.",
+		"help_setcountry":           "- `/%[1]s setcountry XX` merkt sich dein Land für deine Vorschauen und eingefügten Links; `/%[1]s setcountry clear` vergisst es.",
+		"help_visibility":           "- `/%s visibility public|private` legt deine Standardeinstellung fest.",
+		"help_unfurl":               "- `/%s unfurl on|off` schaltet automatische Vorschauen in diesem Kanal ein oder aus (Kanal-Admins).",
+		"help_stats":                "- `/%s stats` zeigt, für wie viele Links du eine Vorschau erstellt hast; `--all` zeigt die Gesamtzahlen (System-Admins).",
+		"help_cache":                "- `/%s cache clear|stats` leert den Cache oder zeigt seine Größe und Trefferquote (System-Admins).",
+		"help_test":                 "- `/%s test [Musik-URL]` prüft die Verbindung zu Odesli, ohne etwas zu posten (System-Admins).",
+		"help_help":                 "- `/%s help` zeigt diese Nachricht.",
+		"help_platforms":            "Plattformen: %s",
+		"cache_forbidden":           "Nur System-Admins können den Cache verwalten.",
+		"cache_usage":               "Verwendung: /%s cache clear|stats",
+		"cache_cleared":             "%d zwischengespeicherte Abfragen wurden gelöscht.",
+		"cache_stats":               "#### Songlink-Cache\n- Einträge: %d von %d\n- Treffer: %d, Fehlschläge: %d\n- Trefferquote: %s",
+		"cache_rate_none":           "k. A.",
+		"chip_songlink":             "Auf Songlink öffnen",
+		"chip_more":                 "+%d weitere",
+		"all_links":                 "Alle Links",
+		"shared_from":               "Geteilt von %s",
+		"digest_title":              "Kürzlich geteilte Musik",
+		"digest_fallback":           "Kürzlich geteilte Musik (%d)",
+		"thread_summary_title":      "Thread-Playlist",
+		"thread_summary_fallback":   "Thread-Playlist (%d Titel)",
+		"thread_summary_more":       "…und %d weitere",
+	},
+}
+
+// tr renders message id in locale, falling back to English and then to the
+// id itself.
+func tr(locale, id string, args ...any) string {
+	format, ok := messages[baseLanguage(locale)][id]
+	if !ok {
+		if format, ok = messages[defaultLocale][id]; !ok {
+			format = id
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// baseLanguage is the language part of a locale ("pt-BR" → "pt").
+func baseLanguage(locale string) string {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return defaultLocale
+	}
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// userLocale is userID's language setting, or the server default.
+func (p *Plugin) userLocale(userID string) string {
+	if user, appErr := p.API.GetUser(userID); appErr == nil && user.Locale != "" {
+		return user.Locale
+	}
+	return p.serverLocale()
+}
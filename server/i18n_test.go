@@ -0,0 +1,47 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fmtVerbs matches the verbs in a catalog entry, ignoring literal %%.
+var fmtVerbs = regexp.MustCompile(`%(\[\d+\])?[a-z]`)
+
+func TestCatalogsMatch(t *testing.T) {
+	for lang, catalog := range messages {
+		if lang == defaultLocale {
+			continue
+		}
+		for id, en := range messages[defaultLocale] {
+			translated, ok := catalog[id]
+			if !assert.True(t, ok, "%s is missing %q", lang, id) {
+				continue
+			}
+			want, got := fmtVerbs.FindAllString(en, -1), fmtVerbs.FindAllString(translated, -1)
+			sort.Strings(want)
+			sort.Strings(got)
+			assert.Equal(t, want, got, "%s %q", lang, id)
+		}
+		for id := range catalog {
+			assert.Contains(t, messages[defaultLocale], id, "%s has %q, which English doesn't", lang, id)
+		}
+	}
+}
+
+func TestTr(t *testing.T) {
+	assert.Equal(t, "Dieser Beitrag enthält keinen Musiklink.", tr("de-AT", "no_music_link"))
+	assert.Equal(t, "That post doesn’t contain a music link.", tr("fr", "no_music_link"))
+	assert.Equal(t, "Usage: /songlink visibility public|private", tr("en", "visibility_usage", "songlink"))
+	assert.Equal(t, "no_such_id", tr("en", "no_such_id"))
+}
+
+func TestHelpIsTranslated(t *testing.T) {
+	cfg := &Config{}
+	assert.Contains(t, cfg.help("en"), "`/songlink help` shows this message.")
+	assert.Contains(t, cfg.help("de"), "`/songlink help` zeigt diese Nachricht.")
+	assert.Contains(t, cfg.help("de"), "`/songlink setcountry clear` vergisst es.")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// ---- KV helpers ----
+
+// kvCASRetries bounds compare-and-set loops under contention.
+const kvCASRetries = 5
+
+var errKVContention = errors.New("kv value kept changing, gave up")
+
+// kvUpdateJSON loads the JSON value at key into a fresh T, lets fn modify it
+// and writes it back with compare-and-set, retrying on contention. fn may run
+// more than once and returns false to leave the stored value untouched.
+func kvUpdateJSON[T any](api plugin.API, key string, fn func(v *T) bool) (*T, error) {
+	for i := 0; i < kvCASRetries; i++ {
+		old, appErr := api.KVGet(key)
+		if appErr != nil {
+			return nil, appErr
+		}
+		var v T
+		if old != nil {
+			if err := json.Unmarshal(old, &v); err != nil {
+				// Replace a corrupt value rather than failing forever.
+				api.LogWarn("resetting unreadable kv value", "key", key, "err", err.Error())
+				v = *new(T)
+			}
+		}
+		if !fn(&v) {
+			return &v, nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		ok, appErr := api.KVCompareAndSet(key, old, data)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if ok {
+			return &v, nil
+		}
+	}
+	return nil, errKVContention
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Platform links ----
+//
+// Cards list their platform links as markdown in the text by default. With
+// LinkButtons they become buttons instead, for integrations that strip
+// markdown and for easier tapping on mobile. Buttons can't open a URL
+// themselves, so pressing one replies with the link to follow.
+
+const openRoute = "/plugins/" + pluginID + "/api/v1/open"
+
+// platformChip is one platform link on a card.
+type platformChip struct {
+	ID    string // platform key, or "songlink" / "more"
+	Label string
+	URL   string
+}
+
+func renderChipText(chips []platformChip, sep string) string {
+	parts := make([]string, 0, len(chips))
+	for _, c := range chips {
+		parts = append(parts, fmt.Sprintf("[%s](%s)", c.Label, c.URL))
+	}
+	return strings.Join(parts, sep)
+}
+
+// renderChipList lists chips one per line as "Label: URL" in a code block,
+// so the whole set can be copied in one go.
+func renderChipList(chips []platformChip) string {
+	lines := make([]string, 0, len(chips))
+	for _, c := range chips {
+		lines = append(lines, c.Label+": "+c.URL)
+	}
+	return "```\n" + strings.Join(lines, "\n") + "\n```"
+}
+
+// renderChipButtons adds a button per chip, and spells the links out in the
+// plain-text fallback so clients without buttons still get them.
+func renderChipButtons(att *model.SlackAttachment, chips []platformChip) {
+	links := make([]string, 0, len(chips))
+	for _, c := range chips {
+		att.Actions = append(att.Actions, &model.PostAction{
+			Id:    "open" + c.ID,
+			Name:  c.Label,
+			Type:  model.PostActionTypeButton,
+			Style: "default",
+			Integration: &model.PostActionIntegration{
+				URL:     openRoute,
+				Context: map[string]any{"label": c.Label, "url": c.URL},
+			},
+		})
+		links = append(links, c.Label+": "+c.URL)
+	}
+	att.Fallback = att.Fallback + "\n" + strings.Join(links, "\n")
+}
+
+// handleOpen answers a platform button with its link.
+func (p *Plugin) handleOpen(w http.ResponseWriter, r *http.Request) {
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid action request")
+		return
+	}
+	label, _ := req.Context["label"].(string)
+	raw, _ := req.Context["url"].(string)
+	link, ok := normalizePlatformURL(raw)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid link")
+		return
+	}
+	text := link
+	if label != "" {
+		text = fmt.Sprintf("[%s](%s)", label, link)
+	}
+	writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{EphemeralText: text})
+}
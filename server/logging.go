@@ -0,0 +1,52 @@
+package main
+
+import "strings"
+
+// ---- Log verbosity ----
+//
+// LogLevel filters the plugin's own log calls on top of the server's log
+// settings. Errors are always logged. Nothing logged here includes the
+// Odesli API key or the Spotify secret.
+
+const (
+	logLevelError = iota
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+)
+
+var logLevels = map[string]int{
+	"error": logLevelError,
+	"warn":  logLevelWarn,
+	"info":  logLevelInfo,
+	"debug": logLevelDebug,
+}
+
+// logLevel is the configured verbosity, warn when unset or unknown.
+func (c *Config) logLevel() int {
+	if c == nil {
+		return logLevelWarn
+	}
+	if l, ok := logLevels[strings.ToLower(strings.TrimSpace(c.LogLevel))]; ok {
+		return l
+	}
+	return logLevelWarn
+}
+
+func (p *Plugin) logWarn(msg string, keyValuePairs ...any) {
+	if p.config().logLevel() >= logLevelWarn {
+		p.API.LogWarn(msg, keyValuePairs...)
+	}
+}
+
+func (p *Plugin) logInfo(msg string, keyValuePairs ...any) {
+	if p.config().logLevel() >= logLevelInfo {
+		p.API.LogInfo(msg, keyValuePairs...)
+	}
+}
+
+func (p *Plugin) logDebug(msg string, keyValuePairs ...any) {
+	if p.config().logLevel() >= logLevelDebug {
+		p.API.LogDebug(msg, keyValuePairs...)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---- Metrics ----
+//
+// Counters for /api/v1/metrics, in Prometheus text format. Like /health the
+// endpoint is unauthenticated so it can be scraped; it exposes counts only.
+
+type lookupMetrics struct {
+	lookups     atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	requests     atomic.Int64 // Odesli HTTP requests made
+	requestNanos atomic.Int64 // total request time
+
+	mu       sync.Mutex
+	failures map[string]int64 // by status code, or "network" / "decode"
+}
+
+// observeRequest records one Odesli request. status is "" on success.
+func (m *lookupMetrics) observeRequest(d time.Duration, status string) {
+	m.requests.Add(1)
+	m.requestNanos.Add(int64(d))
+	if status == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures == nil {
+		m.failures = map[string]int64{}
+	}
+	m.failures[status]++
+}
+
+func (m *lookupMetrics) writePrometheus(w *strings.Builder) {
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("songlink_lookups_total", "Music link lookups.", m.lookups.Load())
+	counter("songlink_cache_hits_total", "Lookups answered from the cache.", m.cacheHits.Load())
+	counter("songlink_cache_misses_total", "Lookups that had to ask Odesli.", m.cacheMisses.Load())
+
+	w.WriteString("# HELP songlink_odesli_request_duration_seconds Odesli request latency.\n")
+	w.WriteString("# TYPE songlink_odesli_request_duration_seconds summary\n")
+	fmt.Fprintf(w, "songlink_odesli_request_duration_seconds_sum %g\n", time.Duration(m.requestNanos.Load()).Seconds())
+	fmt.Fprintf(w, "songlink_odesli_request_duration_seconds_count %d\n", m.requests.Load())
+
+	w.WriteString("# HELP songlink_odesli_errors_total Failed Odesli requests by status.\n")
+	w.WriteString("# TYPE songlink_odesli_errors_total counter\n")
+	m.mu.Lock()
+	statuses := make([]string, 0, len(m.failures))
+	for s := range m.failures {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "songlink_odesli_errors_total{status=%q} %d\n", s, m.failures[s])
+	}
+	m.mu.Unlock()
+}
+
+func (p *Plugin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	p.metrics.writePrometheus(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
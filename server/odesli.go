@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Odesli client ----
+//
+// OdesliClient talks to the Odesli API and knows nothing about Mattermost:
+// caching, retries, enrichment and rendering cards happen in the plugin.
+
+const defaultOdesliBaseURL = "https://api.song.link/v1-alpha.1"
+
+// OdesliResult is the part of an Odesli /links response the plugin uses.
+type OdesliResult struct {
+	EntityUniqueId     string `json:"entityUniqueId"`
+	PageUrl            string `json:"pageUrl"`
+	EntitiesByUniqueId map[string]struct {
+		Title        string `json:"title"`
+		ArtistName   string `json:"artistName"`
+		ThumbnailUrl string `json:"thumbnailUrl"`
+	} `json:"entitiesByUniqueId"`
+	LinksByPlatform map[string]struct {
+		Url string `json:"url"`
+	} `json:"linksByPlatform"`
+}
+
+// OdesliClient resolves music links with the Odesli /links endpoint.
+type OdesliClient struct {
+	HTTPClient *http.Client
+	// BaseURL has no trailing slash; empty means the public API.
+	BaseURL string
+	// APIKey is sent as the key parameter when set.
+	APIKey string
+	// SongIfSingle asks Odesli to resolve single-track albums to the song.
+	SongIfSingle bool
+	// Breaker, if set, fails requests fast with errOdesliUnavailable while
+	// Odesli looks down.
+	Breaker *circuitBreaker
+
+	// Observe, if set, is called after every request with its duration and
+	// "" on success, else the failure ("network", "decode" or the status).
+	Observe func(d time.Duration, failure string)
+	// LogDebug, if set, receives the start of undecodable responses.
+	LogDebug func(msg string, keyValuePairs ...any)
+}
+
+// Resolve asks Odesli about musicURL, optionally for a country. A non-200
+// answer is returned as an *odesliStatusError.
+func (c *OdesliClient) Resolve(ctx context.Context, musicURL, country string) (o *OdesliResult, err error) {
+	q := url.Values{"url": {musicURL}}
+	if country != "" {
+		q.Set("userCountry", country)
+	}
+	if c.SongIfSingle {
+		q.Set("songIfSingle", "true")
+	}
+	if c.APIKey != "" {
+		q.Set("key", c.APIKey)
+	}
+	base := c.BaseURL
+	if base == "" {
+		base = defaultOdesliBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/links?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mattermost-Songlink-Plugin/0.1")
+	if c.Breaker != nil {
+		token, ok := c.Breaker.allow(time.Now())
+		if !ok {
+			return nil, errOdesliUnavailable
+		}
+		defer func() {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// Says nothing about Odesli (e.g. deactivation).
+				c.Breaker.cancel(token)
+				return
+			}
+			c.Breaker.record(time.Now(), token, outageFailure(err))
+		}()
+	}
+
+	start := time.Now()
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		c.observe(time.Since(start), "network")
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			// The request URL carries the API key; keep it out of logs.
+			urlErr.URL = redactAPIKey(urlErr.URL)
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		c.observe(time.Since(start), strconv.Itoa(res.StatusCode))
+		statusErr := &odesliStatusError{Code: res.StatusCode}
+		if res.StatusCode == http.StatusTooManyRequests {
+			statusErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, statusErr
+	}
+
+	// Keep the start of the body while decoding from the stream, so a bad
+	// response can be logged without buffering large valid ones.
+	head := &cappedBuffer{max: maxLoggedBodyBytes}
+	o = &OdesliResult{}
+	if err := json.NewDecoder(io.TeeReader(res.Body, head)).Decode(o); err != nil {
+		c.observe(time.Since(start), "decode")
+		if c.LogDebug != nil {
+			c.LogDebug("undecodable odesli response", "err", err.Error(), "body", head.String())
+		}
+		return nil, err
+	}
+	c.observe(time.Since(start), "")
+	return o, nil
+}
+
+func (c *OdesliClient) observe(d time.Duration, failure string) {
+	if c.Observe != nil {
+		c.Observe(d, failure)
+	}
+}
+
+// odesliStatusError is a non-200 answer from Odesli. RetryAfter is set from
+// the Retry-After header when Odesli sent one.
+type odesliStatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *odesliStatusError) Error() string {
+	return fmt.Sprintf("odesli status %d", e.Code)
+}
+
+// odesliBusy reports whether err is Odesli rate limiting us, and how long it
+// asked us to wait (0 if it didn't say).
+func odesliBusy(err error) (time.Duration, bool) {
+	var statusErr *odesliStatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusTooManyRequests {
+		return statusErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form. Missing, malformed or past values give 0.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// maxLoggedBodyBytes bounds the response snippet logged on decode errors.
+const maxLoggedBodyBytes = 64 << 10
+
+// cappedBuffer keeps the first max bytes written to it and silently drops
+// the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "…(truncated)"
+	}
+	return b.buf.String()
+}
+
+// redactAPIKey masks the key query parameter of an Odesli request URL.
+func redactAPIKey(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	if !q.Has("key") {
+		return s
+	}
+	q.Set("key", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
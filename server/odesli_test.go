@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOdesliAPIKey(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, tc := range []struct {
+		name, key, want string
+	}{
+		{"sent when set", " secret-key ", "secret-key"},
+		{"left out when unset", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{OdesliAPIKey: tc.key}
+			var got string
+			var sent bool
+			song := serveFixture(t, "song")
+			newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				got, sent = r.URL.Query().Get("key"), r.URL.Query().Has("key")
+				song(w, r)
+			})
+			p := newTestPlugin(t, newTestAPI(t), cfg)
+
+			_, _, err := p.lookupOdesli(link, "")
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.want != "", sent)
+		})
+	}
+}
+
+func TestOdesliSongIfSingle(t *testing.T) {
+	const link = "https://music.apple.com/us/album/_/697194953"
+	for _, on := range []bool{true, false} {
+		cfg := &Config{SongIfSingle: on}
+		var query url.Values
+		song := serveFixture(t, "song")
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			song(w, r)
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		_, _, err := p.lookupOdesli(link, "")
+		require.NoError(t, err)
+		if on {
+			assert.Equal(t, "true", query.Get("songIfSingle"))
+		} else {
+			assert.False(t, query.Has("songIfSingle"))
+		}
+	}
+}
+
+func TestOdesliAPIKeyNotInErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // refuse connections
+	c := &OdesliClient{BaseURL: srv.URL, APIKey: "secret-key", HTTPClient: http.DefaultClient}
+
+	_, err := c.Resolve(context.Background(), "https://open.spotify.com/track/abc", "")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret-key")
+	assert.Contains(t, err.Error(), "key=REDACTED")
+}
+
+func TestRedactAPIKey(t *testing.T) {
+	assert.Equal(t, "https://api.song.link/v1-alpha.1/links?key=REDACTED&url=x", redactAPIKey("https://api.song.link/v1-alpha.1/links?url=x&key=secret"))
+	assert.Equal(t, "https://api.song.link/v1-alpha.1/links?url=x", redactAPIKey("https://api.song.link/v1-alpha.1/links?url=x"))
+}
+
+func TestLookupBudget(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+
+	t.Run("slow server", func(t *testing.T) {
+		// Well within the per-request timeout, but past the lookup's budget.
+		release := make(chan struct{})
+		cfg := &Config{LookupTimeoutSeconds: 1}
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		})
+		t.Cleanup(func() { close(release) }) // before the server closes
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		start := time.Now()
+		_, _, err := p.lookupOdesli(link, "")
+		assert.ErrorIs(t, err, errLookupTimeout)
+		assert.Less(t, time.Since(start), 3*time.Second)
+	})
+
+	t.Run("stops retrying", func(t *testing.T) {
+		defer func(d time.Duration) { emptyRetryDelay = d }(emptyRetryDelay)
+		emptyRetryDelay = 5 * time.Second
+		cfg := &Config{LookupTimeoutSeconds: 1, RetryOnEmpty: true}
+		var mu sync.Mutex
+		requests := 0
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"entitiesByUniqueId":{},"linksByPlatform":{}}`))
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		start := time.Now()
+		_, _, err := p.lookupOdesli(link, "")
+		assert.ErrorIs(t, err, errLookupTimeout)
+		assert.Less(t, time.Since(start), 3*time.Second)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, 1, requests, "the retry is abandoned once the budget is spent")
+	})
+}
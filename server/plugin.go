@@ -2,77 +2,423 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 )
 
 // Admin-configurable settings (from plugin.json)
 type Config struct {
-	AutoUnfurl  bool
-	UserCountry string
+	CommandTrigger         string
+	CommandsPerMinute      int
+	AllowedTeamIDs         string
+	RestrictToSystemAdmins bool
+
+	BotUsername    string
+	BotDisplayName string
+	BotDescription string
+	PostAsBot      bool
+	ConfirmPosted  bool
+
+	SyncPreview       bool
+	SyncPreviewMillis int
+
+	AutoUnfurl           bool
+	DirectMessageUnfurls string
+	UserCountry          string
+	RetryOnEmpty         bool
+
+	OdesliBaseURL string
+	OdesliAPIKey  string
+	SongIfSingle  bool
+
+	ProxyURL      string
+	ProxyUsername string
+	ProxyPassword string
+	NoProxy       string
+
+	RequestTimeoutSeconds int
+	LookupTimeoutSeconds  int
+	MaxConcurrentLookups  int
+	FollowRedirects       bool
+
+	CircuitBreakerFailures        int
+	CircuitBreakerWindowSeconds   int
+	CircuitBreakerCooldownSeconds int
+
+	EnableThreadSummary    bool
+	ThreadSummaryThreshold int
+	ThreadSummaryEmoji     string
+
+	CompactMode      bool
+	LinkButtons      bool
+	CopyAllLinks     bool
+	ShowRemoveButton bool
+
+	BandcampFallback bool
+
+	Platforms      string
+	ChipSeparator  string
+	PlatformLabels string
+	MaxChips       int
+
+	MaxUnfurlAgeDays   int
+	MultiLinkMode      string
+	MaxUnfurlsPerPost  int
+	MaxScannedLinks    int
+	ExtraMusicHosts    string
+	URLPattern         string
+	UnfurlDedupMinutes int
+
+	EnableSpotifyEnrichment bool
+	SpotifyClientID         string
+	SpotifyClientSecret     string
+
+	ExplicitContent string
+
+	DigestThreshold       int
+	DigestIntervalMinutes int
+
+	CacheTTLMinutes        int
+	CacheMaxEntries        int
+	NewReleaseDays         int
+	NewReleaseCacheMinutes int
+	CatalogCacheHours      int
+
+	WarmCacheURLs            string
+	WarmCacheIntervalMinutes int
+
+	LogLevel string
+
+	allowedTeams    map[string]bool   // parsed AllowedTeamIDs
+	platforms       []string          // parsed Platforms
+	labelOverrides  map[string]string // parsed PlatformLabels
+	extraMusicHosts map[string]bool   // parsed ExtraMusicHosts
 }
 
 // Plugin implements the Mattermost plugin interface.
 type Plugin struct {
 	plugin.MattermostPlugin
 
-	cfg        *Config
-	httpClient *http.Client
-	urlRegex   *regexp.Regexp
+	cfgMu      sync.RWMutex
+	cfg        *Config                        // read with config()
+	httpClient atomic.Pointer[http.Client]    // swapped when the timeout or proxy changes
+	publicTr   atomic.Pointer[http.Transport] // for user-supplied URLs, see publicClient
+	urlRegex   atomic.Pointer[regexp.Regexp]  // swapped when URLPattern changes
+	router     *http.ServeMux
+	spotify    *spotifyEnricher
+	cache      *lookupCache
+	warmJob    *cluster.Job
+	digestJob  *cluster.Job
+	rates      *channelRates
+	userLimits *userLimiter
+	botHealth  botHealth
+	breaker    circuitBreaker // Odesli outages
+	posts      postPacer
+	metrics    lookupMetrics
+	workers    atomic.Pointer[workPool]
+	inflight   singleflight.Group // Odesli lookups in progress, by cache key
+
+	registeredTrigger string // trigger currently registered with the server
+
+	botMu     sync.Mutex
+	botUserID string // set by ensureBot once EnsureBotUser succeeds
+
+	// ctx is cancelled on deactivation so in-flight lookups stop and
+	// nothing is posted afterwards.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewPlugin ensures everything is initialised even if OnActivate changes later.
 func NewPlugin() *Plugin {
-	return &Plugin{
-		httpClient: &http.Client{Timeout: 8 * time.Second},
-		urlRegex:   regexp.MustCompile(`https?://[^\s]+`),
+	p := &Plugin{
+		spotify:    &spotifyEnricher{tracks: map[string]spotifyCacheEntry{}},
+		cache:      newLookupCache(),
+		rates:      newChannelRates(),
+		userLimits: newUserLimiter(),
 	}
+	p.httpClient.Store(&http.Client{Timeout: defaultRequestTimeout})
+	return p
 }
 
+// OnConfigurationChange loads and validates the settings into a fresh Config
+// and only then swaps it in, so a failed load keeps the previous one.
 func (p *Plugin) OnConfigurationChange() error {
 	var c Config
 	if err := p.API.LoadPluginConfiguration(&c); err != nil {
-		return err
+		if p.config() != nil {
+			p.API.LogError("failed to load configuration, keeping the previous one", "err", err.Error())
+		}
+		return fmt.Errorf("failed to load configuration: %w", err)
 	}
-	p.cfg = &c
-	return nil
+	c.allowedTeams = parseIDList(c.AllowedTeamIDs)
+	c.platforms = p.parsePlatforms(c.Platforms)
+	c.labelOverrides = p.parseLabelOverrides(c.PlatformLabels)
+	if sep, ok := parseChipSeparator(c.ChipSeparator); ok {
+		c.ChipSeparator = sep
+	} else {
+		p.logWarn("invalid platform link separator, using default", "separator", c.ChipSeparator, "default", defaultChipSeparator)
+		c.ChipSeparator = ""
+	}
+	c.extraMusicHosts = parseHostList(c.ExtraMusicHosts)
+	re := defaultURLRegex
+	if pattern := strings.TrimSpace(c.URLPattern); pattern != "" {
+		if compiled, err := regexp.Compile(pattern); err != nil {
+			p.logWarn("invalid URL pattern, using default", "pattern", pattern, "err", err.Error(), "default", defaultURLPattern)
+		} else {
+			re = compiled
+		}
+	}
+	c.CommandTrigger = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(c.CommandTrigger, "/")))
+	if c.CommandTrigger != "" && !validTrigger.MatchString(c.CommandTrigger) {
+		p.logWarn("invalid command trigger, using default", "trigger", c.CommandTrigger, "default", defaultTrigger)
+		c.CommandTrigger = ""
+	}
+	c.OdesliBaseURL = strings.TrimRight(strings.TrimSpace(c.OdesliBaseURL), "/")
+	if c.OdesliBaseURL != "" && !validBaseURL(c.OdesliBaseURL) {
+		p.logWarn("invalid Odesli base URL, using default", "url", c.OdesliBaseURL, "default", defaultOdesliBaseURL)
+		c.OdesliBaseURL = ""
+	}
+	if c.UserCountry = strings.TrimSpace(c.UserCountry); c.UserCountry != "" {
+		code, ok := normalizeCountry(c.UserCountry)
+		if !ok {
+			p.logWarn("invalid country code, ignoring", "country", c.UserCountry)
+		}
+		c.UserCountry = code
+	}
+	c.RequestTimeoutSeconds = p.clampRequestTimeout(c.RequestTimeoutSeconds)
+	if c.ProxyURL = strings.TrimSpace(c.ProxyURL); c.ProxyURL != "" {
+		if _, ok := parseProxyURL(c.ProxyURL); !ok {
+			// The URL may carry credentials, so it isn't logged.
+			p.logWarn("invalid proxy URL, not using a proxy")
+			c.ProxyURL = ""
+		}
+	}
+	c.BotUsername = strings.ToLower(strings.TrimSpace(c.BotUsername))
+	if c.BotUsername != "" && !model.IsValidUsername(c.BotUsername) {
+		p.logWarn("invalid bot username, using default", "username", c.BotUsername, "default", defaultBotUsername)
+		c.BotUsername = ""
+	}
+	prev := p.setConfig(&c)
+	p.urlRegex.Store(re)
+	if prev != nil && *prev.bot() != *c.bot() {
+		// EnsureBotUser updates the existing bot to the new profile.
+		p.refreshBot()
+	}
+	p.resizeWorkers()
+	p.breaker.configure(&c)
+	if cur := p.client(); cur == nil || cur.Timeout != c.requestTimeout() || prev == nil || !prev.sameProxy(&c) {
+		// Lookups already running keep the client they loaded.
+		p.httpClient.Store(&http.Client{Timeout: c.requestTimeout(), Transport: newTransport(&c)})
+		p.publicTr.Store(newPublicTransport(&c))
+	}
+	if p.cache != nil {
+		p.cache.setLimit(c.CacheMaxEntries)
+	}
+	p.scheduleCacheWarming()
+	p.scheduleDigest()
+	return p.reregisterCommands()
+}
+
+// config is the current configuration, nil until it first loads.
+func (p *Plugin) config() *Config {
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
+	return p.cfg
+}
+
+// setConfig swaps in c and returns the configuration it replaced.
+func (p *Plugin) setConfig(c *Config) *Config {
+	p.cfgMu.Lock()
+	defer p.cfgMu.Unlock()
+	prev := p.cfg
+	p.cfg = c
+	return prev
 }
 
 func (p *Plugin) OnActivate() error {
+	if p.config() == nil {
+		// The server loads the configuration before activating; if that
+		// failed, try once more rather than run without one.
+		if err := p.OnConfigurationChange(); err != nil {
+			return err
+		}
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
 	// Belt-and-braces: make sure these are set even if NewPlugin wasn’t used.
-	if p.httpClient == nil {
-		p.httpClient = &http.Client{Timeout: 8 * time.Second}
+	if p.client() == nil {
+		p.httpClient.Store(&http.Client{Timeout: p.config().requestTimeout()})
+	}
+	if p.spotify == nil {
+		p.spotify = &spotifyEnricher{tracks: map[string]spotifyCacheEntry{}}
+	}
+	if p.cache == nil {
+		p.cache = newLookupCache()
+		if p.config() != nil {
+			p.cache.setLimit(p.config().CacheMaxEntries)
+		}
 	}
-	if p.urlRegex == nil {
-		p.urlRegex = regexp.MustCompile(`https?://[^\s]+`)
+	if p.rates == nil {
+		p.rates = newChannelRates()
 	}
+	if p.userLimits == nil {
+		p.userLimits = newUserLimiter()
+	}
+	p.router = p.initRouter()
+	p.ensureBotIcon(p.ensureBot())
+	p.scheduleCacheWarming()
+	p.scheduleDigest()
 	// Register /songlink slash command
 	return p.registerCommands()
 }
 
+func (p *Plugin) OnDeactivate() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if wp := p.workers.Load(); wp != nil && !wp.drain(drainTimeout) {
+		p.logWarn("background lookups still running at deactivation")
+	}
+	for _, job := range []*cluster.Job{p.warmJob, p.digestJob} {
+		if job == nil {
+			continue
+		}
+		if err := job.Close(); err != nil {
+			p.logWarn("failed to stop job", "err", err.Error())
+		}
+	}
+	return nil
+}
+
 // ---- Slash command ----
 
+const defaultTrigger = "songlink"
+
+// validTrigger matches what Mattermost accepts as a slash command word.
+var validTrigger = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,127}$`)
+
+func (c *Config) commandTrigger() string {
+	if c == nil || c.CommandTrigger == "" {
+		return defaultTrigger
+	}
+	return c.CommandTrigger
+}
+
+// usage is the one-line usage hint for the configured trigger.
+func (c *Config) usage(locale string) string {
+	return tr(locale, "usage", c.commandTrigger())
+}
+
+// commandAllowed applies RestrictToSystemAdmins and AllowedTeamIDs. With
+// neither set everyone may use the command.
+func (p *Plugin) commandAllowed(userID, teamID string) bool {
+	cfg := p.config()
+	if cfg == nil {
+		return true
+	}
+	if cfg.RestrictToSystemAdmins && !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		return false
+	}
+	if len(cfg.allowedTeams) > 0 && !cfg.allowedTeams[teamID] {
+		return false
+	}
+	return true
+}
+
+// previewRefusal applies commandAllowed and CommandsPerMinute to a preview
+// userID asked for from teamID outside the command: by dialog, share button
+// or post menu. It returns the message id to refuse with, or "" to go ahead.
+func (p *Plugin) previewRefusal(userID, teamID string) string {
+	if !p.commandAllowed(userID, teamID) {
+		return "not_permitted"
+	}
+	if limit := p.config().commandsPerMinute(); limit > 0 && !p.userLimits.allow(userID, limit, time.Now()) {
+		return "too_fast"
+	}
+	return ""
+}
+
+// parseIDList reads a comma- or whitespace-separated list of ids.
+func parseIDList(raw string) map[string]bool {
+	out := map[string]bool{}
+	for _, id := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		out[id] = true
+	}
+	return out
+}
+
+// help is the full "/songlink help" text in locale.
+func (c *Config) help(locale string) string {
+	t := c.commandTrigger()
+	var platforms []string
+	for _, k := range c.platformOrder() {
+		platforms = append(platforms, c.platformLabel(k))
+	}
+	lines := []string{
+		"#### Songlink",
+		tr(locale, "help_post", t),
+		tr(locale, "help_form", t),
+		tr(locale, "help_private"),
+		tr(locale, "help_preview", t),
+		tr(locale, "help_country"),
+		tr(locale, "help_compact"),
+		tr(locale, "help_thread", t),
+		tr(locale, "help_setcountry", t),
+		tr(locale, "help_visibility", t),
+		tr(locale, "help_unfurl", t),
+		tr(locale, "help_stats", t),
+		tr(locale, "help_cache", t),
+		tr(locale, "help_test", t),
+		tr(locale, "help_help", t),
+		"",
+		tr(locale, "help_platforms", strings.Join(platforms, ", ")),
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (p *Plugin) registerCommands() error {
+	trigger := p.config().commandTrigger()
 	cmd := &model.Command{
-		Trigger:          "songlink",
+		Trigger:          trigger,
 		AutoComplete:     true,
-		AutoCompleteDesc: "Create a smart music preview from a URL. Usage: /songlink <url>",
+		AutoCompleteDesc: fmt.Sprintf("Create a smart music preview from a URL. Usage: /%s <url>", trigger),
 		DisplayName:      "Songlink",
 	}
 	if appErr := p.API.RegisterCommand(cmd); appErr != nil {
 		return appErr
 	}
+	p.registeredTrigger = trigger
 	return nil
 }
 
+// reregisterCommands swaps the slash command over when CommandTrigger changes
+// after activation.
+func (p *Plugin) reregisterCommands() error {
+	if p.registeredTrigger == "" || p.registeredTrigger == p.config().commandTrigger() {
+		return nil
+	}
+	if err := p.API.UnregisterCommand("", p.registeredTrigger); err != nil {
+		p.logWarn("failed to unregister old command", "trigger", p.registeredTrigger, "err", err.Error())
+	}
+	return p.registerCommands()
+}
+
 func (p *Plugin) ExecuteCommand(ctx *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
 	// Never let a panic kill the plugin process.
 	defer func() {
@@ -83,217 +429,1527 @@ func (p *Plugin) ExecuteCommand(ctx *plugin.Context, args *model.CommandArgs) (*
 	if args == nil || strings.TrimSpace(args.Command) == "" {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "Usage: /songlink <music-url>",
+			Text:         p.config().usage(defaultLocale),
 		}, nil
 	}
+	locale := p.userLocale(args.UserId)
+
+	if !p.commandAllowed(args.UserId, args.TeamId) {
+		return p.textResponse(tr(locale, "not_permitted")), nil
+	}
 
-	parts := strings.Fields(args.Command)
-	if len(parts) < 2 {
+	in := parseCommand(args.Command)
+	p.logDebug("command received", "user_id", args.UserId, "channel_id", args.ChannelId, "subcommand", in.Subcommand, "urls", len(in.URLs))
+	switch in.Subcommand {
+	case "visibility":
+		return p.executeVisibility(args.UserId, in), nil
+	case "unfurl":
+		return p.executeUnfurl(args, in), nil
+	case "setcountry":
+		return p.executeSetCountry(args.UserId, in), nil
+	case "test":
+		return p.executeTest(args.UserId, in), nil
+	case "stats":
+		return p.executeStats(args.UserId, in), nil
+	case "cache":
+		return p.executeCache(args.UserId, in), nil
+	case "thread":
+		// Preview the thread's links like links typed after the trigger.
+		urls, resp := p.threadMusicURLs(args, locale)
+		if resp != nil {
+			return resp, nil
+		}
+		in.URLs = urls
+	case "help":
+		return p.textResponse(p.config().help(locale)), nil
+	}
+	if in.empty() && args.TriggerId != "" {
+		// Bare trigger: ask for the link in a form instead.
+		return p.openPreviewDialog(args), nil
+	}
+	if len(in.URLs) == 0 {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         "Usage: /songlink <music-url>",
+			Text:         p.config().usage(locale),
 		}, nil
 	}
-	musicURL := cleanMusicURL(parts[1])
+	if len(in.URLs) > maxPreviewURLs {
+		return p.textResponse(tr(locale, "too_many_links", maxPreviewURLs)), nil
+	}
+
+	country, ok := in.country()
+	if !ok {
+		return p.textResponse(tr(locale, "bad_country_flag")), nil
+	}
+	prefs := p.userPrefs(args.UserId)
+	if country == "" {
+		country = prefs.Country
+	}
+
+	req := previewRequest{
+		UserID:    args.UserId,
+		TeamID:    args.TeamId,
+		ChannelID: args.ChannelId,
+		RootID:    args.RootId,
+		URLs:      in.URLs,
+		// Words typed around the link ("/songlink check this out <url>")
+		// become the post's caption.
+		Caption: in.Caption(),
+		Country: country,
+		Private: in.visibility(prefs.Visibility) == visibilityPrivate,
+		Compact: in.HasFlag("compact"),
+	}
+
+	// Check up front so the user gets a clear answer instead of a failed
+	// CreatePost from the background goroutine.
+	if !req.Private {
+		if refusal := p.postRefusal(args.UserId, args.ChannelId); refusal != "" {
+			return p.textResponse(tr(locale, refusal)), nil
+		}
+	}
+
+	if limit := p.config().commandsPerMinute(); limit > 0 && !p.userLimits.allow(args.UserId, limit, time.Now()) {
+		return p.textResponse(tr(locale, "too_fast")), nil
+	}
+
+	// Post the preview before answering when it's quick. Only for previews
+	// the user posts publicly.
+	if wait := p.config().syncPreviewWait(); wait > 0 && !req.Private && !p.config().PostAsBot {
+		if resp, ok := p.syncPreview(req, wait, locale); ok {
+			return resp, nil
+		}
+		return p.textResponse(tr(locale, "busy")), nil
+	}
 
 	// Kick work to background so the UI clears instantly.
-	userID := args.UserId
-	channelID := args.ChannelId
-	go func(url string) {
-		att, err := p.lookupOdesli(url)
-		if err != nil || att == nil {
-			// Tell the user quietly if it fails.
-			p.API.SendEphemeralPost(userID, &model.Post{
-				ChannelId: channelID,
-				Message:   "Couldn’t fetch details for that link.",
-			})
-			if err != nil {
-				p.API.LogError("odesli lookup failed", "err", err.Error())
-			}
-			return
+	if !p.submit(func() { p.postPreview(req) }) {
+		return p.textResponse(tr(locale, "busy")), nil
+	}
+
+	// Immediate, lightweight response — clears the input and shows a hint.
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         tr(locale, "fetching"),
+	}, nil
+}
+
+// previewRequest is one preview asked for via the command, dialog or share
+// button.
+type previewRequest struct {
+	UserID    string
+	TeamID    string // team the request came from, for permalinks in DMs
+	ChannelID string
+	RootID    string   // thread the command was run in, empty at channel root
+	URLs      []string // one card each, in this order
+	Caption   string
+	Country   string // overrides UserCountry when set
+	// Private shows the cards only to UserID, with a button to share them.
+	Private bool
+	// Compact renders these cards as with CompactMode, whatever the setting.
+	Compact bool
+}
+
+const (
+	// maxPreviewURLs bounds how many links one /songlink can preview.
+	maxPreviewURLs = 10
+	// maxBatchLookups bounds concurrent lookups for one preview.
+	maxBatchLookups = 4
+)
+
+// previewResult is the outcome of looking up a preview's links: the cards
+// that resolved, how many didn't, and the last lookup error.
+type previewResult struct {
+	atts   []*model.SlackAttachment
+	tracks []previewTrack // what each card shows, for the preview_posted event
+	failed int
+	err    error
+}
+
+// lookupPreview resolves req's links into cards.
+func (p *Plugin) lookupPreview(req previewRequest) previewResult {
+	country := req.Country
+	if country == "" {
+		country = p.config().country()
+	}
+	atts, tracks, failed, err := p.lookupAll(req.URLs, country)
+	p.recordPreviewStats(req.UserID, len(req.URLs), len(atts))
+	if req.Compact {
+		for _, att := range atts {
+			compactAttachment(att)
 		}
-		// Post the result as the invoking user (no channel-join fuss).
-		post := &model.Post{
-			UserId:    userID,
+	}
+	return previewResult{atts: atts, tracks: tracks, failed: failed, err: err}
+}
+
+// failureMessage explains to the user why none of the links resolved.
+func (p *Plugin) failureMessage(locale string, err error) string {
+	if errors.Is(err, errExplicitBlocked) {
+		return tr(locale, "explicit_blocked")
+	}
+	if errors.Is(err, errLookupTimeout) {
+		return tr(locale, "lookup_timeout")
+	}
+	if errors.Is(err, errOdesliUnavailable) {
+		return tr(locale, "odesli_unavailable")
+	}
+	if errors.Is(err, errNoLinks) {
+		return tr(locale, "no_details")
+	}
+	if retryAfter, busy := odesliBusy(err); busy {
+		return odesliBusyMessage(locale, retryAfter)
+	}
+	if err != nil {
+		p.API.LogError("odesli lookup failed", "err", err.Error())
+	}
+	return tr(locale, "lookup_failed")
+}
+
+// previewMessage is the post text: the caption, plus a note when some links
+// couldn't be previewed.
+func (p *Plugin) previewMessage(req previewRequest, res previewResult) string {
+	message := req.Caption
+	if res.failed > 0 {
+		// Part of the shared post, so in the server's language.
+		note := tr(p.serverLocale(), "partial_failures", res.failed, len(req.URLs))
+		message = strings.TrimSpace(message + "\n\n" + note)
+	}
+	return message
+}
+
+// postPreview resolves the links and posts one message with a card per link
+// as the user, with the caption as the message text. Failures are reported
+// to the user ephemerally.
+func (p *Plugin) postPreview(req previewRequest) {
+	p.deliverPreview(req, p.lookupPreview(req))
+}
+
+// deliverPreview posts the looked-up preview, or tells the user why not.
+func (p *Plugin) deliverPreview(req previewRequest, res previewResult) {
+	userID, channelID := req.UserID, req.ChannelID
+	if p.context().Err() != nil {
+		// Deactivated while looking up: don't post after shutdown.
+		return
+	}
+	locale := p.userLocale(userID)
+	atts := res.atts
+	if len(atts) == 0 {
+		// Tell the user quietly if it fails.
+		p.API.SendEphemeralPost(userID, &model.Post{
 			ChannelId: channelID,
+			RootId:    req.RootID,
+			Message:   p.failureMessage(locale, res.err),
+		})
+		return
+	}
+	message := p.previewMessage(req, res)
+
+	if req.Private {
+		last := atts[len(atts)-1]
+		last.Actions = append(last.Actions, shareAction(req, locale))
+		p.API.SendEphemeralPost(userID, &model.Post{
+			ChannelId: channelID,
+			RootId:    req.RootID,
+			Message:   message,
 			Props: map[string]any{
-				"attachments": []*model.SlackAttachment{att},
+				"attachments": atts,
 			},
-		}
-		if _, appErr := p.API.CreatePost(post); appErr != nil {
+		})
+		return
+	}
+
+	created := p.createPreviewPost(req, message, atts, locale)
+	if created == nil {
+		return
+	}
+	p.publishPreviewPosted(created, res.tracks)
+	if p.config().ConfirmPosted {
+		if link := p.permalink(created, req.TeamID); link != "" {
 			p.API.SendEphemeralPost(userID, &model.Post{
 				ChannelId: channelID,
-				Message:   "Failed to post preview.",
+				RootId:    req.RootID,
+				Message:   tr(locale, "posted_confirmation", link),
 			})
-			p.API.LogError("CreatePost failed", "err", appErr.Error())
 		}
-	}(musicURL)
+	}
+}
 
-	// Immediate, lightweight response — clears the input and shows a hint.
-	return &model.CommandResponse{
-		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         "Fetching preview…",
-	}, nil
+// createPreviewPost posts the cards in req's channel as the invoking user (no
+// channel-join fuss), or as the bot with PostAsBot. On failure it tells the
+// user and returns nil.
+func (p *Plugin) createPreviewPost(req previewRequest, message string, atts []*model.SlackAttachment, locale string) *model.Post {
+	userID, channelID := req.UserID, req.ChannelID
+	post := &model.Post{
+		UserId:    userID,
+		ChannelId: channelID,
+		RootId:    req.RootID,
+		Message:   message,
+		Props: map[string]any{
+			"attachments": atts,
+			previewProp:   true,
+		},
+	}
+	var created *model.Post
+	var postErr error
+	if p.config() != nil && p.config().PostAsBot {
+		created, postErr = p.createBotPost(post)
+	} else if c, appErr := p.createPost(post); appErr != nil {
+		postErr = appErr
+	} else {
+		created = c
+	}
+	if postErr != nil {
+		p.API.LogError("CreatePost failed", "err", postErr.Error())
+		if notChannelMember(postErr) {
+			// Still show the preview, just to the user who asked for it.
+			post.Message = strings.TrimSpace(tr(locale, "posted_privately") + "\n\n" + message)
+			p.API.SendEphemeralPost(userID, post)
+			return nil
+		}
+		p.API.SendEphemeralPost(userID, &model.Post{
+			ChannelId: channelID,
+			RootId:    req.RootID,
+			Message:   tr(locale, "post_failed"),
+		})
+		return nil
+	}
+	return created
+}
+
+// permalink links to post, in its channel's team or, for DMs and GMs, in
+// teamID. It is relative when SiteURL isn't set, and "" when there's no team
+// to put in it.
+func (p *Plugin) permalink(post *model.Post, teamID string) string {
+	if ch, appErr := p.API.GetChannel(post.ChannelId); appErr == nil && ch.TeamId != "" {
+		teamID = ch.TeamId
+	}
+	if teamID == "" {
+		return ""
+	}
+	team, appErr := p.API.GetTeam(teamID)
+	if appErr != nil {
+		p.logWarn("failed to load team for permalink", "team_id", teamID, "err", appErr.Error())
+		return ""
+	}
+	site := ""
+	if cfg := p.API.GetConfig(); cfg != nil && cfg.ServiceSettings.SiteURL != nil {
+		site = strings.TrimRight(*cfg.ServiceSettings.SiteURL, "/")
+	}
+	return site + "/" + team.Name + "/pl/" + post.Id
+}
+
+// lookupAll resolves urls concurrently, keeping input order. It returns the
+// cards that resolved with their tracks, how many didn't, and the last lookup
+// error.
+func (p *Plugin) lookupAll(urls []string, country string) ([]*model.SlackAttachment, []previewTrack, int, error) {
+	results := make([]*model.SlackAttachment, len(urls))
+	tracks := make([]previewTrack, len(urls))
+	errs := make([]error, len(urls))
+	sem := make(chan struct{}, maxBatchLookups)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], tracks[i], errs[i] = p.lookupOdesli(u, country)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		atts     []*model.SlackAttachment
+		resolved []previewTrack
+		lastErr  error
+	)
+	for i, att := range results {
+		if errs[i] != nil {
+			lastErr = errs[i]
+		}
+		if att != nil && errs[i] == nil {
+			atts = append(atts, att)
+			resolved = append(resolved, tracks[i])
+		}
+	}
+	return atts, resolved, len(urls) - len(atts), lastErr
 }
 
 // ---- Optional unfurl on paste ----
 
 func (p *Plugin) MessageWillBePosted(ctx *plugin.Context, post *model.Post) (*model.Post, string) {
-	if p.cfg == nil || !p.cfg.AutoUnfurl {
+	if p.config() == nil || post == nil || p.isOwnPost(post) {
 		return post, ""
 	}
-	if post == nil || p.urlRegex == nil {
+
+	// Count every message, not just ones with links: busy is busy.
+	busy := p.config().digestEnabled() && p.rates.hit(post.ChannelId, time.Now()) >= float64(p.config().DigestThreshold)
+
+	urls := p.config().limitUnfurls(p.postMusicURLs(post))
+	// Only posts with music links pay for the per-channel lookup.
+	if len(urls) == 0 || !p.unfurlEnabled(post.ChannelId) {
 		return post, ""
 	}
+	p.unfurlAll(post, urls, busy)
+	return post, ""
+}
 
-	urls := p.urlRegex.FindAllString(post.Message, -1)
-	if len(urls) == 0 {
-		return post, ""
+// DirectMessageUnfurls values: how links in DMs and GMs are unfurled.
+const (
+	directUnfurlUser = "user" // post the preview as whoever shared the link
+	directUnfurlBot  = "bot"  // post as the bot, like other channels
+	directUnfurlOff  = "off"  // don't unfurl
+)
+
+// directUnfurls is DirectMessageUnfurls, "user" when unset or unknown.
+func (c *Config) directUnfurls() string {
+	if c != nil && (c.DirectMessageUnfurls == directUnfurlBot || c.DirectMessageUnfurls == directUnfurlOff) {
+		return c.DirectMessageUnfurls
 	}
+	return directUnfurlUser
+}
 
-	att, err := p.lookupOdesli(urls[0])
-	if err != nil || att == nil {
-		return post, ""
+// isDirectChannel reports whether channelID is a DM or GM.
+func (p *Plugin) isDirectChannel(channelID string) bool {
+	ch, appErr := p.API.GetChannel(channelID)
+	return appErr == nil && (ch.Type == model.ChannelTypeDirect || ch.Type == model.ChannelTypeGroup)
+}
+
+// unfurlsAsUser reports whether previews in channelID are posted as the user
+// who shared the link rather than the bot.
+func (p *Plugin) unfurlsAsUser(channelID string) bool {
+	return p.config().directUnfurls() != directUnfurlBot && p.isDirectChannel(channelID)
+}
+
+// unfurlAll unfurls urls from post in the background, or queues them for the
+// digest when the channel is busy.
+func (p *Plugin) unfurlAll(post *model.Post, urls []string, busy bool) {
+	if p.config().directUnfurls() == directUnfurlOff && p.isDirectChannel(post.ChannelId) {
+		return
+	}
+	// The digest is posted by the bot, so previews posted as the sharer
+	// skip it.
+	if busy && !p.unfurlsAsUser(post.ChannelId) {
+		p.logInfo("busy channel, queueing links for the digest", "channel_id", post.ChannelId, "links", len(urls))
+		p.queueForDigest(post, urls)
+		return
+	}
+	p.logDebug("unfurling music links", "channel_id", post.ChannelId, "urls", strings.Join(urls, " "))
+	// Look up in the background so the post goes through straight away.
+	shared := post.Clone()
+	for _, u := range urls {
+		if !p.submit(func() { p.unfurl(shared, u) }) {
+			p.logWarn("too many lookups running, not unfurling link", "channel_id", post.ChannelId, "url", u)
+		}
+	}
+}
+
+// isOwnPost reports whether post is by the Songlink bot, whose previews
+// carry links of their own that must not be unfurled again.
+func (p *Plugin) isOwnPost(post *model.Post) bool {
+	return post.UserId != "" && post.UserId == p.ensureBot()
+}
+
+// MessageWillBeUpdated unfurls links added by editing a post, with the same
+// channel setting, digest and dedup rules as new posts. Links the post
+// already had are left alone. Edits don't count towards the channel's rate.
+func (p *Plugin) MessageWillBeUpdated(ctx *plugin.Context, newPost, oldPost *model.Post) (*model.Post, string) {
+	if p.config() == nil || newPost == nil || p.isOwnPost(newPost) {
+		return newPost, ""
+	}
+	if p.config().tooOldToUnfurl(newPost, time.Now()) {
+		return newPost, ""
+	}
+
+	before := map[string]bool{}
+	if oldPost != nil {
+		for _, u := range p.postMusicURLs(oldPost) {
+			before[u] = true
+		}
+	}
+	var added []string
+	for _, u := range p.postMusicURLs(newPost) {
+		if !before[u] {
+			added = append(added, u)
+		}
+	}
+	added = p.config().limitUnfurls(added)
+	if len(added) == 0 || !p.unfurlEnabled(newPost.ChannelId) {
+		return newPost, ""
+	}
+	busy := p.config().digestEnabled() && p.rates.rate(newPost.ChannelId, time.Now()) >= float64(p.config().DigestThreshold)
+	p.unfurlAll(newPost, added, busy)
+	return newPost, ""
+}
+
+const (
+	multiLinkFirst = "first"
+	multiLinkAll   = "all"
+
+	defaultMaxUnfurlsPerPost = 3
+)
+
+// limitUnfurls applies MultiLinkMode and MaxUnfurlsPerPost to the music links
+// found in a post. Every link is unfurled unless MultiLinkMode is "first".
+func (c *Config) limitUnfurls(urls []string) []string {
+	if len(urls) > 1 && c != nil && c.MultiLinkMode == multiLinkFirst {
+		return urls[:1]
+	}
+	limit := defaultMaxUnfurlsPerPost
+	if c != nil && c.MaxUnfurlsPerPost > 0 {
+		limit = c.MaxUnfurlsPerPost
+	}
+	if len(urls) > limit {
+		return urls[:limit]
+	}
+	return urls
+}
+
+// tooOldToUnfurl reports whether post is past MaxUnfurlAgeDays, so editing an
+// old message doesn't make the bot reply in a long-dead thread.
+func (c *Config) tooOldToUnfurl(post *model.Post, now time.Time) bool {
+	if c == nil || c.MaxUnfurlAgeDays <= 0 || post.CreateAt == 0 {
+		return false
+	}
+	maxAge := time.Duration(c.MaxUnfurlAgeDays) * 24 * time.Hour
+	return now.Sub(time.UnixMilli(post.CreateAt)) > maxAge
+}
+
+// unfurl resolves musicURL and replies to post's thread with the preview.
+func (p *Plugin) unfurl(post *model.Post, musicURL string) {
+	if !p.unfurlsAsUser(post.ChannelId) && !p.botHealth.available(time.Now()) {
+		return
+	}
+	if !p.claimUnfurl(post.ChannelId, musicURL) {
+		// Unfurled here moments ago.
+		return
 	}
+	att, track, err := p.lookupOdesli(musicURL, p.userCountry(post.UserId))
+	if err != nil || att == nil || p.context().Err() != nil {
+		p.releaseUnfurl(post.ChannelId, musicURL)
+		return
+	}
+
+	rootID := post.RootId
+	if rootID == "" {
+		rootID = post.Id
+	}
+	if err := p.postUnfurl(post.ChannelId, rootID, post.UserId, att, track); err != nil {
+		p.releaseUnfurl(post.ChannelId, musicURL)
+		if !errors.Is(err, errBotUnavailable) {
+			p.logWarn("failed to create unfurl post", "err", err.Error())
+		}
+		return
+	}
+	p.recordThreadTrack(post.ChannelId, rootID, att)
+}
 
-	// Reply in thread via bot
-	botID := p.ensureBot()
-	reply := &model.Post{
-		UserId:    botID,
-		ChannelId: post.ChannelId,
-		RootId:    post.Id,
+// postUnfurl replies in rootID's thread with the preview of a link shared by
+// posterID: as the bot, or as posterID in DMs and GMs unless
+// DirectMessageUnfurls is "bot".
+func (p *Plugin) postUnfurl(channelID, rootID, posterID string, att *model.SlackAttachment, track previewTrack) error {
+	post := &model.Post{
+		ChannelId: channelID,
+		RootId:    rootID,
 		Props: map[string]any{
 			"attachments": []*model.SlackAttachment{att},
 		},
 	}
-	if _, appErr := p.API.CreatePost(reply); appErr != nil {
-		p.API.LogWarn("failed to create unfurl post", "err", appErr.Error())
+	if p.unfurlsAsUser(channelID) {
+		// The bot can't join a DM, and shouldn't barge into one anyway.
+		post.UserId = posterID
+		post.AddProp(previewProp, true)
+		created, appErr := p.createPost(post)
+		if appErr != nil {
+			return appErr
+		}
+		p.publishPreviewPosted(created, []previewTrack{track})
+		return nil
 	}
-	return post, ""
+	// Posts as the sharer need no Remove button: they can delete them.
+	if p.config() != nil && p.config().ShowRemoveButton {
+		// The button is on a shared post, so in the server's language.
+		att.Actions = append(att.Actions, removeAction(posterID, p.serverLocale()))
+	}
+	created, err := p.createBotPost(post)
+	if notChannelMember(err) {
+		// The bot can't join this channel; show the poster the preview
+		// instead, without a Remove button for a post that doesn't exist.
+		private := *att
+		private.Actions = nil
+		post.Props = map[string]any{"attachments": []*model.SlackAttachment{&private}}
+		p.API.SendEphemeralPost(posterID, post)
+	}
+	if err != nil {
+		return err
+	}
+	p.publishPreviewPosted(created, []previewTrack{track})
+	return nil
 }
 
-// ---- Odesli client ----
+// ---- Odesli lookups ----
 
-type odesliResponse struct {
-	EntityUniqueId     string `json:"entityUniqueId"`
-	PageUrl            string `json:"pageUrl"`
-	EntitiesByUniqueId map[string]struct {
-		Title        string `json:"title"`
-		ArtistName   string `json:"artistName"`
-		ThumbnailUrl string `json:"thumbnailUrl"`
-	} `json:"entitiesByUniqueId"`
-	LinksByPlatform map[string]struct {
-		Url string `json:"url"`
-	} `json:"linksByPlatform"`
-}
+var errNoLinks = errors.New("odesli returned no links for that url")
 
-func (p *Plugin) lookupOdesli(musicURL string) (*model.SlackAttachment, error) {
-	if p.httpClient == nil {
-		return nil, fmt.Errorf("http client not initialised")
+// lookupOdesli resolves musicURL for country ("" for none) and renders the
+// card. The track describes what the card shows.
+func (p *Plugin) lookupOdesli(musicURL, country string) (*model.SlackAttachment, previewTrack, error) {
+	if p.client() == nil {
+		return nil, previewTrack{}, fmt.Errorf("http client not initialised")
 	}
 	if strings.TrimSpace(musicURL) == "" {
-		return nil, fmt.Errorf("empty url")
+		return nil, previewTrack{}, fmt.Errorf("empty url")
+	}
+	p.metrics.lookups.Add(1)
+	start := time.Now()
+	ctx, cancel := p.lookupContext()
+	defer cancel()
+	if p.config().needsExpanding(musicURL) {
+		expanded := p.expandURL(ctx, musicURL)
+		p.logDebug("expanded short link", "url", musicURL, "target", expanded)
+		musicURL = expanded
 	}
+	defer func() {
+		p.logDebug("lookup finished", "url", musicURL, "country", country, "took", time.Since(start).String())
+	}()
 
-	q := url.Values{"url": {musicURL}}
-	if p.cfg != nil && strings.TrimSpace(p.cfg.UserCountry) != "" {
-		q.Set("userCountry", strings.TrimSpace(p.cfg.UserCountry))
+	o, err := p.resolve(ctx, musicURL, country)
+	// Odesli often knows Bandcamp pages only by URL; the page itself has the
+	// details then.
+	if (err != nil || len(o.EntitiesByUniqueId) == 0 || isDegenerate(o)) && p.config() != nil && p.config().BandcampFallback && isBandcampURL(musicURL) {
+		if att, track, bcErr := p.lookupBandcamp(ctx, musicURL); bcErr == nil {
+			return att, track, nil
+		} else if !errors.Is(bcErr, errNotMusicPage) {
+			p.logWarn("bandcamp fallback failed", "err", bcErr.Error())
+		}
+	}
+	if err != nil {
+		return nil, previewTrack{}, err
+	}
+	att := buildAttachment(o, p.config(), p.serverLocale())
+	if att == nil {
+		return nil, previewTrack{}, errNoLinks
+	}
+	track := p.spotifyInfo(o)
+	if track != nil && p.cache != nil {
+		// Now that we know how old the release is, adjust how long it stays cached.
+		p.cache.retune(cacheKey(musicURL, country), p.config().cacheTTL(track.releaseDate(), time.Now()))
+	}
+	addSpotifyFields(att, track, p.config(), p.serverLocale())
+	if err := applyExplicitPolicy(att, track, p.config()); err != nil {
+		return nil, previewTrack{}, err
 	}
-	api := "https://api.song.link/v1-alpha.1/links?" + q.Encode()
+	return att, trackFromResult(o), nil
+}
 
-	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, api, nil)
-	req.Header.Set("User-Agent", "Mattermost-Songlink-Plugin/0.1")
+// resolve returns the Odesli response for musicURL, from cache when possible.
+// Once ctx's deadline passes it stops retrying and returns errLookupTimeout.
+func (p *Plugin) resolve(ctx context.Context, musicURL, country string) (*OdesliResult, error) {
+	key := cacheKey(musicURL, country)
+	if p.cache != nil {
+		if o, ok := p.cache.get(key); ok {
+			p.metrics.cacheHits.Add(1)
+			p.logDebug("lookup cache hit", "url", musicURL, "country", country)
+			return o, nil
+		}
+	}
+	p.metrics.cacheMisses.Add(1)
+	p.logDebug("lookup cache miss, asking Odesli", "url", musicURL, "country", country)
 
-	res, err := p.httpClient.Do(req)
+	// Concurrent misses for the same link share one upstream lookup.
+	v, err, _ := p.inflight.Do(key, func() (any, error) {
+		o, err := p.odesliClient().Resolve(ctx, musicURL, country)
+		// New releases sometimes come back with an empty entity set on the
+		// first hit and complete a moment later. Retry exactly once.
+		if err == nil && len(o.EntitiesByUniqueId) == 0 && p.config() != nil && p.config().RetryOnEmpty {
+			if !sleepContext(ctx, emptyRetryDelay) {
+				return nil, lookupError(ctx)
+			}
+			o, err = p.odesliClient().Resolve(ctx, musicURL, country)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, lookupError(ctx)
+			}
+			return nil, err
+		}
+		// Incomplete results aren't cached so the next share gets another try.
+		if p.cache != nil && len(o.EntitiesByUniqueId) > 0 {
+			p.cache.set(key, o, p.config().cacheTTLDefault())
+		}
+		return o, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("odesli status %d", res.StatusCode)
+	return v.(*OdesliResult), nil
+}
+
+// odesliClient is an Odesli client for the current configuration, reporting
+// to the plugin's metrics and log.
+func (p *Plugin) odesliClient() *OdesliClient {
+	return &OdesliClient{
+		HTTPClient:   p.client(),
+		BaseURL:      p.config().odesliBaseURL(),
+		APIKey:       p.config().odesliAPIKey(),
+		SongIfSingle: p.config() != nil && p.config().SongIfSingle,
+		Breaker:      &p.breaker,
+		Observe:      p.metrics.observeRequest,
+		LogDebug:     p.logDebug,
 	}
+}
 
-	var o odesliResponse
-	if err := json.NewDecoder(res.Body).Decode(&o); err != nil {
-		return nil, err
+// odesliBaseURL is OdesliBaseURL without a trailing slash, or the public API.
+func (c *Config) odesliBaseURL() string {
+	if c == nil || c.OdesliBaseURL == "" {
+		return defaultOdesliBaseURL
+	}
+	return c.OdesliBaseURL
+}
+
+func (c *Config) odesliAPIKey() string {
+	if c == nil {
+		return ""
+	}
+	return strings.TrimSpace(c.OdesliAPIKey)
+}
+
+// validBaseURL reports whether s is an absolute http(s) URL with a host and
+// no query or fragment, so "/links?…" can be appended to it.
+func validBaseURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.RawQuery == "" && u.Fragment == ""
+}
+
+func (c *Config) country() string {
+	if c == nil {
+		return ""
+	}
+	return c.UserCountry
+}
+
+// emptyRetryDelay is how long to wait before re-asking Odesli when the first
+// response had no entities. A variable so tests needn't wait.
+var emptyRetryDelay = 1500 * time.Millisecond
+
+// odesliBusyMessage tells the user Odesli is rate limiting, with the wait when
+// known.
+func odesliBusyMessage(locale string, retryAfter time.Duration) string {
+	if retryAfter <= 0 {
+		return tr(locale, "odesli_busy")
+	}
+	return tr(locale, "odesli_busy_wait", retryAfter.Round(time.Second))
+}
+
+// buildAttachment renders an Odesli response as a card, with its own labels
+// in locale. cfg may be nil. It returns nil when the response has nothing to
+// link to.
+func buildAttachment(o *OdesliResult, cfg *Config, locale string) *model.SlackAttachment {
+	if isDegenerate(o) {
+		return nil
 	}
+	compact := cfg != nil && cfg.CompactMode
 
 	// Build attachment safely
-	title := "Track"
+	kind := entityKind(o.EntityUniqueId)
+	title := kind
 	artist := ""
 	if ent, ok := o.EntitiesByUniqueId[o.EntityUniqueId]; ok {
 		if strings.TrimSpace(ent.Title) != "" {
-			title = ent.Title
+			title = strings.TrimSpace(ent.Title)
 		}
-		artist = ent.ArtistName
+		artist = strings.TrimSpace(ent.ArtistName)
+	}
+	// Playlists often have no artist; joinHeading leaves no dangling dash.
+	heading := joinHeading(artist, title)
+	if kind == entityEpisode {
+		// For episodes the "artist" is the show: "Episode — Show".
+		heading = joinHeading(title, artist)
 	}
 
 	att := &model.SlackAttachment{
-		Fallback:  strings.TrimSpace(fmt.Sprintf("%s — %s", artist, title)),
-		Title:     strings.TrimSpace(fmt.Sprintf("%s — %s", artist, title)),
+		Fallback:  heading,
+		Title:     heading,
 		TitleLink: o.PageUrl,
 	}
-	if ent, ok := o.EntitiesByUniqueId[o.EntityUniqueId]; ok && strings.TrimSpace(ent.ThumbnailUrl) != "" {
+	if kind != entityTrack {
+		// Say what the link is when it isn't a single track.
+		att.AuthorName = kind
+		att.Fallback = kind + ": " + heading
+	}
+	// Compact cards are just the linked title plus the chips.
+	if ent, ok := o.EntitiesByUniqueId[o.EntityUniqueId]; ok && !compact && strings.TrimSpace(ent.ThumbnailUrl) != "" {
 		att.ThumbURL = ent.ThumbnailUrl
 	}
 
 	// Add a few platform buttons inline
-	var chips []string
-    allowed := []string{
-        "spotify",
-        "itunes",
-        "appleMusic",
-        "youtubeMusic",
-        "qobuz",
-        "tidal",
-        "amazonMusic",
-        "soundcloud",
-        "bandcamp",
-    }
-    labels := map[string]string{
-        "spotify":      "Spotify",
-        "itunes":       "iTunes",
-        "appleMusic":   "Apple Music",
-        "youtubeMusic": "YouTube Music",
-        "qobuz":       "Qobuz",
-        "tidal":        "TIDAL",
-        "amazonMusic":  "Amazon Music",
-        "soundcloud":   "SoundCloud",
-        "bandcamp":     "Bandcamp",
-    }
-    for _, k := range allowed {
-        if v, ok := o.LinksByPlatform[k]; ok && v.Url != "" {
-            chips = append(chips, fmt.Sprintf("[%s](%s)", labels[k], v.Url))
-        }
-    }
-	if len(chips) > 0 {
-		att.Text = strings.Join(chips, " • ")
-	}
-	return att, nil
+	var chips []platformChip
+	for _, k := range cfg.platformOrder() {
+		if v, ok := o.LinksByPlatform[k]; ok {
+			if link, ok := normalizePlatformURL(v.Url); ok {
+				chips = append(chips, platformChip{ID: k, Label: cfg.platformLabel(k), URL: link})
+			}
+		}
+	}
+	if len(chips) == 0 {
+		// Some obscure releases resolve to just a title, with no usable
+		// platform links; the song.link page is always one working link.
+		page, ok := normalizePlatformURL(o.PageUrl)
+		if !ok {
+			return nil
+		}
+		chips = append(chips, platformChip{ID: "songlink", Label: tr(locale, "chip_songlink"), URL: page})
+	}
+	if cfg != nil && cfg.CopyAllLinks && !compact {
+		// Every link, before MaxChips cuts the chips short.
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{Title: tr(locale, "all_links"), Value: renderChipList(chips)})
+	}
+	if limit := cfg.maxChips(); limit > 0 && len(chips) > limit {
+		if page, ok := normalizePlatformURL(o.PageUrl); ok {
+			more := len(chips) - limit
+			chips = append(chips[:limit], platformChip{ID: "more", Label: tr(locale, "chip_more", more), URL: page})
+		}
+	}
+	if cfg != nil && cfg.LinkButtons {
+		renderChipButtons(att, chips)
+	} else {
+		att.Text = renderChipText(chips, cfg.chipSeparator())
+	}
+	if src := sourcePlatform(o.EntityUniqueId); src != "" {
+		att.Footer = tr(locale, "shared_from", src)
+	}
+	att.Color = providerColor(entityProvider(o.EntityUniqueId))
+	return att
+}
+
+// isDegenerate reports whether o has nothing worth a card: the shared entity
+// has no title, artist or thumbnail, and no platform has a usable link. Its
+// card would be a bare "Track" heading, at best linking to song.link.
+func isDegenerate(o *OdesliResult) bool {
+	ent := o.EntitiesByUniqueId[o.EntityUniqueId]
+	if strings.TrimSpace(ent.Title) != "" || strings.TrimSpace(ent.ArtistName) != "" || strings.TrimSpace(ent.ThumbnailUrl) != "" {
+		return false
+	}
+	for _, v := range o.LinksByPlatform {
+		if _, ok := normalizePlatformURL(v.Url); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compactAttachment trims a full card down to what CompactMode shows: the
+// linked title and the platform links.
+func compactAttachment(att *model.SlackAttachment) {
+	att.ThumbURL = ""
+	att.ImageURL = ""
+	att.Fields = nil
+}
+
+// Entity kinds, as shown on the card and used as the title when Odesli has
+// none.
+const (
+	entityTrack    = "Track"
+	entityAlbum    = "Album"
+	entityPlaylist = "Playlist"
+	entityEpisode  = "Episode"
+	entityPodcast  = "Podcast"
+)
+
+// entityKind reads the entity type from an Odesli entity id
+// ("SPOTIFY_ALBUM::…"). Songs, videos and unknown types count as tracks.
+func entityKind(entityID string) string {
+	prefix, _, _ := strings.Cut(entityID, "::")
+	switch {
+	case strings.HasSuffix(prefix, "_ALBUM"):
+		return entityAlbum
+	case strings.HasSuffix(prefix, "_PLAYLIST"):
+		return entityPlaylist
+	case strings.HasSuffix(prefix, "_EPISODE"):
+		return entityEpisode
+	case strings.HasSuffix(prefix, "_PODCAST"), strings.HasSuffix(prefix, "_SHOW"):
+		return entityPodcast
+	default:
+		return entityTrack
+	}
+}
+
+// sourceProviders names the provider prefix of an Odesli entity id
+// ("SPOTIFY_SONG::…"), which tells where the shared link came from.
+var sourceProviders = map[string]string{
+	"SPOTIFY":    "Spotify",
+	"ITUNES":     "Apple Music",
+	"YOUTUBE":    "YouTube",
+	"TIDAL":      "TIDAL",
+	"AMAZON":     "Amazon Music",
+	"DEEZER":     "Deezer",
+	"SOUNDCLOUD": "SoundCloud",
+	"PANDORA":    "Pandora",
+	"NAPSTER":    "Napster",
+	"YANDEX":     "Yandex Music",
+	"AUDIOMACK":  "Audiomack",
+	"AUDIUS":     "Audius",
+	"ANGHAMI":    "Anghami",
+	"BOOMPLAY":   "Boomplay",
+}
+
+// sourcePlatform returns the friendly name of the entity's provider, or ""
+// when the prefix isn't one we know.
+func sourcePlatform(entityID string) string {
+	return sourceProviders[entityProvider(entityID)]
+}
+
+// entityProvider is the provider part of an Odesli entity id ("SPOTIFY"),
+// or "" when the id has no prefix.
+func entityProvider(entityID string) string {
+	prefix, _, ok := strings.Cut(entityID, "::")
+	if !ok {
+		return ""
+	}
+	provider, _, _ := strings.Cut(prefix, "_")
+	return provider
+}
+
+const neutralColor = "#8E8E93"
+
+// providerColors are the brand colors used for the card's side bar.
+var providerColors = map[string]string{
+	"SPOTIFY":    "#1DB954",
+	"ITUNES":     "#FA2D48",
+	"YOUTUBE":    "#FF0000",
+	"TIDAL":      "#000000",
+	"AMAZON":     "#25D1DA",
+	"DEEZER":     "#A238FF",
+	"SOUNDCLOUD": "#FF5500",
+	"PANDORA":    "#3668FF",
+	"NAPSTER":    "#0A0A0A",
+	"YANDEX":     "#FFCC00",
+	"AUDIOMACK":  "#FFA200",
+	"AUDIUS":     "#CC0FE0",
+	"ANGHAMI":    "#8F00FF",
+	"BOOMPLAY":   "#1B62E9",
+	"BANDCAMP":   "#1DA0C3",
+}
+
+// providerColor picks the side bar color for a provider, neutral grey when
+// it's unknown.
+func providerColor(provider string) string {
+	if c, ok := providerColors[provider]; ok {
+		return c
+	}
+	return neutralColor
+}
+
+// normalizePlatformURL makes an upstream link safe to render: protocol-less
+// ("//host/…") and scheme-less ("host/…") forms get https, anything without
+// an http(s) scheme and host (e.g. a bare relative path) is rejected.
+func normalizePlatformURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "":
+		return "", false
+	case strings.HasPrefix(raw, "//"):
+		raw = "https:" + raw
+	case !strings.Contains(raw, "://") && bareHostRegex.MatchString(raw):
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// defaultPlatforms is the order platform chips are shown in.
+var defaultPlatforms = []string{
+	"spotify",
+	"itunes",
+	"appleMusic",
+	"youtubeMusic",
+	"qobuz",
+	"tidal",
+	"amazonMusic",
+	"soundcloud",
+	"bandcamp",
+	"deezer",
+	"pandora",
+	"napster",
+	"yandex",
+}
+
+// platformLabels are the chip labels for each Odesli platform key.
+var platformLabels = map[string]string{
+	"spotify":      "Spotify",
+	"itunes":       "iTunes",
+	"appleMusic":   "Apple Music",
+	"youtubeMusic": "YouTube Music",
+	"qobuz":        "Qobuz",
+	"tidal":        "TIDAL",
+	"amazonMusic":  "Amazon Music",
+	"soundcloud":   "SoundCloud",
+	"bandcamp":     "Bandcamp",
+	"deezer":       "Deezer",
+	"pandora":      "Pandora",
+	"napster":      "Napster",
+	"yandex":       "Yandex Music",
+}
+
+const defaultChipSeparator = " • "
+
+// platformOrder is the configured chip order, or defaultPlatforms.
+func (c *Config) platformOrder() []string {
+	if c == nil || len(c.platforms) == 0 {
+		return defaultPlatforms
+	}
+	return c.platforms
+}
+
+// parsePlatforms reads Platforms ("spotify, appleMusic, …"). Unknown keys are
+// kept, since Odesli adds platforms over time, but warned about in case of a
+// typo.
+func (p *Plugin) parsePlatforms(raw string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, key := range strings.Split(raw, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, ok := platformLabels[key]; !ok {
+			p.logWarn("unknown platform key in Platforms; it only shows if Odesli returns it", "platform", key)
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+func (c *Config) platformLabel(key string) string {
+	if c != nil {
+		if l, ok := c.labelOverrides[key]; ok {
+			return l
+		}
+	}
+	if l, ok := platformLabels[key]; ok {
+		return l
+	}
+	return key
+}
+
+func (c *Config) chipSeparator() string {
+	if c == nil || c.ChipSeparator == "" {
+		return defaultChipSeparator
+	}
+	return c.ChipSeparator
+}
+
+// maxChipSeparatorLen bounds ChipSeparator, in characters.
+const maxChipSeparatorLen = 10
+
+// parseChipSeparator reads ChipSeparator, where "\n" stands for a line
+// break. Characters that would change the markdown around the links, and
+// other control characters, are rejected.
+func parseChipSeparator(raw string) (string, bool) {
+	sep := strings.ReplaceAll(raw, `\n`, "\n")
+	if utf8.RuneCountInString(sep) > maxChipSeparatorLen {
+		return "", false
+	}
+	for _, r := range sep {
+		if strings.ContainsRune("[]()<>*_`~#\\!", r) || (unicode.IsControl(r) && r != '\n') {
+			return "", false
+		}
+	}
+	return sep, true
+}
+
+const defaultMaxChips = 6
+
+// maxChips is MaxChips, defaulting to 6. A negative value shows every
+// platform.
+func (c *Config) maxChips() int {
+	if c == nil || c.MaxChips == 0 {
+		return defaultMaxChips
+	}
+	return c.MaxChips
+}
+
+// parseLabelOverrides reads "key=Label, key=Label". Malformed or empty
+// entries are logged and skipped.
+func (p *Plugin) parseLabelOverrides(raw string) map[string]string {
+	out := map[string]string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, label, ok := strings.Cut(entry, "=")
+		key, label = strings.TrimSpace(key), strings.TrimSpace(label)
+		if !ok || key == "" || label == "" {
+			p.logWarn("ignoring invalid platform label override", "entry", entry)
+			continue
+		}
+		out[key] = label
+	}
+	return out
 }
 
 func cleanMusicURL(s string) string {
 	s = strings.TrimSpace(s)
 	// Strip surrounding angle brackets often added by chat clients
 	s = strings.Trim(s, "<>")
-	// Trim common trailing punctuation
+	// Trim common trailing punctuation. A closing bracket stays when it
+	// closes one opened inside the URL ("…/Song_(Remix)").
 	for len(s) > 0 {
 		last := s[len(s)-1]
-		if last == ')' || last == '.' || last == ',' || last == ']' || last == '>' {
-			s = s[:len(s)-1]
-			continue
+		switch {
+		case last == '.' || last == ',' || last == '>':
+		case last == ')' && unbalanced(s, '(', ')'):
+		case last == ']' && unbalanced(s, '[', ']'):
+		default:
+			return cleanedURL(s)
 		}
-		break
+		s = s[:len(s)-1]
 	}
+	return cleanedURL(s)
+}
+
+// unbalanced reports whether s has more closing than opening brackets, i.e.
+// its trailing closer belongs to the surrounding text.
+func unbalanced(s string, opener, closer byte) bool {
+	return strings.Count(s, string(closer)) > strings.Count(s, string(opener))
+}
+
+func cleanedURL(s string) string {
 	// Ensure scheme is present
 	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
 		s = "https://" + s
 	}
-	return s
+	return filterQueryParams(normalizeAppleURL(punycodeHost(s)))
+}
+
+// appleHosts are the hosts Apple Music and iTunes links are shared from.
+var appleHosts = map[string]bool{
+	"music.apple.com":     true,
+	"geo.music.apple.com": true,
+	"itunes.apple.com":    true,
+}
+
+// appleIDSegment matches iTunes-style resource IDs ("id1440857781").
+var appleIDSegment = regexp.MustCompile(`^id(\d+)$`)
+
+// normalizeAppleURL rewrites Apple Music and iTunes links to the canonical
+// https://music.apple.com form: geo. and itunes. hosts become music.apple.com,
+// "id123" path segments lose their prefix and the fragment is dropped. The
+// ?i= track selector is kept by filterQueryParams; locale parameters (l, ls,
+// app, …) are not. Other URLs are returned unchanged.
+func normalizeAppleURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !appleHosts[strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")] {
+		return s
+	}
+	u.Scheme = "https"
+	u.Host = "music.apple.com"
+	u.Fragment = ""
+	segments := strings.Split(u.Path, "/")
+	for i, seg := range segments {
+		if m := appleIDSegment.FindStringSubmatch(seg); m != nil {
+			segments[i] = m[1]
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// punycodeHost rewrites an internationalized host to its ASCII (punycode)
+// form so the same site always produces the same URL and host checks compare
+// like with like.
+func punycodeHost(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+	host := asciiHost(u.Hostname())
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+	if host == u.Host {
+		return s
+	}
+	u.Host = host
+	return u.String()
+}
+
+// asciiHost lower-cases host and converts it to punycode. Hosts idna rejects
+// are returned lower-cased as-is; they won't match any known host.
+func asciiHost(host string) string {
+	host = strings.ToLower(host)
+	if a, err := idna.Lookup.ToASCII(host); err == nil {
+		return a
+	}
+	return host
+}
+
+// preservedQueryParams lists, per known music host, the query parameters that
+// select the target resource. Any other parameter on these hosts (si, utm_*,
+// fbclid, …) is dropped. Hosts not listed here only lose trackingParams.
+var preservedQueryParams = map[string][]string{
+	"open.spotify.com":    {},
+	"spotify.com":         {},
+	"music.apple.com":     {"i"},
+	"geo.music.apple.com": {"i"},
+	"itunes.apple.com":    {"i"},
+	"youtube.com":         {"v", "list", "t"},
+	"m.youtube.com":       {"v", "list", "t"},
+	"music.youtube.com":   {"v", "list", "t"},
+	"youtu.be":            {"list", "t"},
+	"tidal.com":           {},
+	"listen.tidal.com":    {},
+	"soundcloud.com":      {},
+	"bandcamp.com":        {},
+	"deezer.com":          {},
+	"deezer.page.link":    {},
+	"spotify.link":        {},
+	"spotify.app.link":    {},
+	"link.deezer.com":     {},
+	"on.soundcloud.com":   {},
+	"music.amazon.com":    {"trackAsin"},
+	"open.qobuz.com":      {},
+	"play.qobuz.com":      {},
+}
+
+// trackingParams are dropped from links on hosts without an allowlist (e.g.
+// ExtraMusicHosts). Names ending in "*" are prefixes.
+var trackingParams = []string{
+	"si", "utm_*", "igshid", "igsh", "fbclid", "gclid", "dclid", "msclkid",
+	"mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok", "ref_src", "yclid", "twclid",
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, t := range trackingParams {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// filterQueryParams keeps only the allowlisted query parameters for known
+// music hosts, and drops known tracking parameters everywhere else.
+func filterQueryParams(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.RawQuery == "" {
+		return s
+	}
+	keep, ok := allowedParamsForHost(u.Hostname())
+	if !ok {
+		return stripTrackingParams(u, s)
+	}
+	q := u.Query()
+	kept := url.Values{}
+	for _, k := range keep {
+		if v, ok := q[k]; ok {
+			kept[k] = v
+		}
+	}
+	u.RawQuery = kept.Encode()
+	return u.String()
+}
+
+// stripTrackingParams removes tracking parameters from u, returning the
+// original s untouched when there were none so parameter order survives.
+func stripTrackingParams(u *url.URL, s string) string {
+	q := u.Query()
+	removed := false
+	for k := range q {
+		if isTrackingParam(k) {
+			q.Del(k)
+			removed = true
+		}
+	}
+	if !removed {
+		return s
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func allowedParamsForHost(host string) ([]string, bool) {
+	host = strings.TrimPrefix(asciiHost(host), "www.")
+	if keep, ok := preservedQueryParams[host]; ok {
+		return keep, true
+	}
+	// Bandcamp artists live on subdomains (artist.bandcamp.com).
+	if strings.HasSuffix(host, ".bandcamp.com") {
+		return preservedQueryParams["bandcamp.com"], true
+	}
+	return nil, false
+}
+
+// parseHostList reads a comma- or newline-separated list of hosts. Schemes,
+// paths and a leading "www." are tolerated, so pasted URLs work too.
+func parseHostList(raw string) map[string]bool {
+	out := map[string]bool{}
+	for _, f := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		f = strings.TrimSpace(f)
+		if i := strings.Index(f, "://"); i >= 0 {
+			f = f[i+3:]
+		}
+		if i := strings.IndexAny(f, "/?#"); i >= 0 {
+			f = f[:i]
+		}
+		if f = strings.TrimPrefix(asciiHost(f), "www."); f != "" {
+			out[f] = true
+		}
+	}
+	return out
 }
 
 // ---- Helpers ----
 
+const (
+	defaultRequestTimeout = 8 * time.Second
+	minRequestTimeout     = 2
+	maxRequestTimeout     = 30
+)
+
+// client is the HTTP client for outbound requests; nil before activation
+// when NewPlugin wasn't used.
+func (p *Plugin) client() *http.Client {
+	return p.httpClient.Load()
+}
+
+// clampRequestTimeout keeps RequestTimeoutSeconds within 2–30 seconds. Zero
+// means the default and is left alone.
+func (p *Plugin) clampRequestTimeout(secs int) int {
+	if secs == 0 {
+		return 0
+	}
+	clamped := max(minRequestTimeout, min(maxRequestTimeout, secs))
+	if clamped != secs {
+		p.logWarn("request timeout out of range, clamping", "seconds", secs, "using", clamped)
+	}
+	return clamped
+}
+
+const defaultLookupTimeout = 15 * time.Second
+
+// lookupTimeout is the budget for a whole lookup, including short-link
+// expansion, retries and the Bandcamp fallback: LookupTimeoutSeconds, or
+// 15s. RequestTimeoutSeconds still bounds each single request.
+func (c *Config) lookupTimeout() time.Duration {
+	if c == nil || c.LookupTimeoutSeconds <= 0 {
+		return defaultLookupTimeout
+	}
+	return time.Duration(c.LookupTimeoutSeconds) * time.Second
+}
+
+// lookupContext is the plugin context limited to one lookup's budget.
+func (p *Plugin) lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(p.context(), p.config().lookupTimeout())
+}
+
+var errLookupTimeout = errors.New("music link lookup timed out")
+
+// lookupError is why a lookup under ctx stopped: errLookupTimeout when its
+// budget ran out, otherwise ctx's error (deactivation).
+func lookupError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errLookupTimeout
+	}
+	return ctx.Err()
+}
+
+func (c *Config) requestTimeout() time.Duration {
+	if c == nil || c.RequestTimeoutSeconds == 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(c.RequestTimeoutSeconds) * time.Second
+}
+
+// active reports whether the plugin has activated and not yet deactivated.
+func (p *Plugin) active() bool {
+	return p.ctx != nil && p.ctx.Err() == nil
+}
+
+// context is the plugin lifetime context: cancelled on deactivation.
+func (p *Plugin) context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// sleepContext waits for d, returning false early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// canPost reports whether userID may create posts in channelID.
+func (p *Plugin) canPost(userID, channelID string) bool {
+	return p.API.HasPermissionToChannel(userID, channelID, model.PermissionCreatePost)
+}
+
+// postRefusal checks that userID's public preview can be posted in
+// channelID: by them, and with PostAsBot by the bot as well. It returns the
+// message id to refuse with, or "" to go ahead.
+func (p *Plugin) postRefusal(userID, channelID string) string {
+	if !p.canPost(userID, channelID) {
+		return "cannot_post"
+	}
+	if p.config() != nil && p.config().PostAsBot {
+		if botID := p.ensureBot(); botID != "" && !p.botCanPost(botID, channelID) {
+			return "bot_cannot_post"
+		}
+	}
+	return ""
+}
+
+// botCanPost reports whether the bot may post in channelID, or may join it
+// first as createBotPost does for public channels.
+func (p *Plugin) botCanPost(botID, channelID string) bool {
+	if p.canPost(botID, channelID) {
+		return true
+	}
+	ch, appErr := p.API.GetChannel(channelID)
+	return appErr == nil && ch.Type == model.ChannelTypeOpen &&
+		p.API.HasPermissionToTeam(botID, ch.TeamId, model.PermissionJoinPublicChannels)
+}
+
+// defaultURLPattern finds links in message text when URLPattern is empty.
+const defaultURLPattern = `https?://[^\s]+`
+
+var defaultURLRegex = regexp.MustCompile(defaultURLPattern)
+
+const (
+	// defaultMaxScannedLinks bounds how many links are looked at per
+	// message, music or not.
+	defaultMaxScannedLinks = 20
+	// maxScannedBytes bounds how much of a message is searched for links.
+	maxScannedBytes = 16 << 10
+)
+
+// maxScannedLinks is MaxScannedLinks, or -1 for no limit.
+func (c *Config) maxScannedLinks() int {
+	if c == nil || c.MaxScannedLinks == 0 {
+		return defaultMaxScannedLinks
+	}
+	if c.MaxScannedLinks < 0 {
+		return -1
+	}
+	return c.MaxScannedLinks
+}
+
+// scanPrefix cuts msg to at most maxScannedBytes, at whitespace so the last
+// link isn't cut in half.
+func scanPrefix(msg string) string {
+	if len(msg) <= maxScannedBytes {
+		return msg
+	}
+	msg = msg[:maxScannedBytes]
+	if i := strings.LastIndexFunc(msg, unicode.IsSpace); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// musicURLs returns the cleaned music links in msg, in order. Anything not on
+// a known music host is dropped so it never reaches Odesli. Only the first
+// MaxScannedLinks links in the first maxScannedBytes are looked at.
+func (p *Plugin) musicURLs(msg string) []string {
+	re := p.urlRegex.Load()
+	if re == nil {
+		re = defaultURLRegex
+	}
+	var out []string
+	seen := map[string]bool{}
+	for _, u := range re.FindAllString(scanPrefix(msg), p.config().maxScannedLinks()) {
+		if u = cleanMusicURL(u); p.config().isMusicURL(u) && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// previewProp marks posts carrying /songlink preview cards, whose links
+// must not be unfurled again.
+const previewProp = "songlink_preview"
+
+// postMusicURLs is musicURLs for a whole post: the message text first, then
+// the title, author and text of attachments added by integrations. Only
+// those attachment fields are read, and only music hosts count, so unrelated
+// props can't trigger an unfurl.
+func (p *Plugin) postMusicURLs(post *model.Post) []string {
+	urls := p.musicURLs(post.Message)
+	if post.GetProp(previewProp) != nil {
+		return urls
+	}
+	seen := map[string]bool{}
+	for _, u := range urls {
+		seen[u] = true
+	}
+	for _, att := range post.Attachments() {
+		if att == nil {
+			continue
+		}
+		text := strings.Join([]string{att.TitleLink, att.AuthorLink, att.Pretext, att.Text}, " ")
+		for _, u := range p.musicURLs(text) {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// firstMusicURL returns the first music link in msg, or "" if there is none.
+func (p *Plugin) firstMusicURL(msg string) string {
+	if urls := p.musicURLs(msg); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+// isMusicURL reports whether s is on a known music host or one the admin
+// added in ExtraMusicHosts.
+func (c *Config) isMusicURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	if _, ok := allowedParamsForHost(u.Hostname()); ok {
+		return true
+	}
+	if c == nil || len(c.extraMusicHosts) == 0 {
+		return false
+	}
+	host := asciiHost(u.Hostname())
+	for h := range c.extraMusicHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Plugin) textResponse(msg string) *model.CommandResponse {
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
@@ -301,15 +1957,61 @@ func (p *Plugin) textResponse(msg string) *model.CommandResponse {
 	}
 }
 
+// ensureBot returns the bot's user id, calling EnsureBotUser only until it
+// first succeeds.
 func (p *Plugin) ensureBot() string {
-	id, err := p.API.EnsureBotUser(&model.Bot{
-		Username:    "songlink",
-		DisplayName: "Songlink",
-		Description: "Smart music links by Odesli",
-	})
+	p.botMu.Lock()
+	defer p.botMu.Unlock()
+	if p.botUserID == "" {
+		p.botUserID = p.ensureBotUser()
+	}
+	return p.botUserID
+}
+
+// refreshBot re-applies the configured bot profile, e.g. after BotUsername
+// changed.
+func (p *Plugin) refreshBot() {
+	p.botMu.Lock()
+	defer p.botMu.Unlock()
+	if id := p.ensureBotUser(); id != "" {
+		p.botUserID = id
+	}
+}
+
+func (p *Plugin) ensureBotUser() string {
+	id, err := p.API.EnsureBotUser(p.config().bot())
 	if err != nil {
-		p.API.LogWarn("EnsureBotUser failed", "err", err.Error())
+		p.logWarn("EnsureBotUser failed", "err", err.Error())
 		return ""
 	}
 	return id
-}
\ No newline at end of file
+}
+
+const (
+	defaultBotUsername    = "songlink"
+	defaultBotDisplayName = "Songlink"
+	defaultBotDescription = "Smart music links by Odesli"
+)
+
+// bot is the bot account from BotUsername, BotDisplayName and
+// BotDescription, each falling back to the built-in default.
+func (c *Config) bot() *model.Bot {
+	b := &model.Bot{
+		Username:    defaultBotUsername,
+		DisplayName: defaultBotDisplayName,
+		Description: defaultBotDescription,
+	}
+	if c == nil {
+		return b
+	}
+	if c.BotUsername != "" {
+		b.Username = c.BotUsername
+	}
+	if s := strings.TrimSpace(c.BotDisplayName); s != "" {
+		b.DisplayName = s
+	}
+	if s := strings.TrimSpace(c.BotDescription); s != "" {
+		b.Description = s
+	}
+	return b
+}
@@ -0,0 +1,1330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// ---- Test harness ----
+//
+// Tests run the plugin against plugintest's mock API, with an httptest server
+// standing in for Odesli via OdesliBaseURL. newTestAPI accepts any logging
+// and keeps KV values in memory; everything else a test needs it sets up
+// itself.
+
+const testBotID = "botuserid"
+
+// newTestAPI returns a mock API that accepts logging, keeps KV values in
+// memory and knows the bot.
+func newTestAPI(t *testing.T) *plugintest.API {
+	api := plugintest.NewAPI(t)
+	for _, level := range []string{"LogError", "LogWarn", "LogInfo", "LogDebug"} {
+		for n := 1; n <= 15; n++ {
+			args := make([]any, n)
+			for i := range args {
+				args[i] = mock.Anything
+			}
+			api.On(level, args...).Maybe()
+		}
+	}
+	kv := &memKV{data: map[string][]byte{}}
+	kv.register(api)
+	api.On("EnsureBotUser", mock.Anything).Return(testBotID, nil).Maybe()
+	api.On("GetConfig").Return(&model.Config{}).Maybe()
+	api.On("PublishWebSocketEvent", mock.Anything, mock.Anything, mock.Anything).Maybe()
+	return api
+}
+
+// newTestPlugin returns a plugin on api with cfg loaded through
+// OnConfigurationChange, as the server does before activating it. Changing
+// *cfg and calling OnConfigurationChange again applies the change.
+func newTestPlugin(t *testing.T, api *plugintest.API, cfg *Config) *Plugin {
+	api.On("LoadPluginConfiguration", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Config) = *cfg
+	}).Return(nil).Maybe()
+	p := NewPlugin()
+	p.SetAPI(api)
+	require.NoError(t, p.OnConfigurationChange())
+	t.Cleanup(func() { _ = p.OnDeactivate() })
+	return p
+}
+
+// newOdesliServer serves handler as the Odesli API and points cfg at it.
+func newOdesliServer(t *testing.T, cfg *Config, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cfg.OdesliBaseURL = srv.URL
+	return srv
+}
+
+// serveFixture answers every request with testdata/odesli/<name>.json.
+func serveFixture(t *testing.T, name string) http.HandlerFunc {
+	body := readFixture(t, name)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "odesli", name+".json"))
+	require.NoError(t, err)
+	return body
+}
+
+// withUser makes GetUser return a user with locale.
+func withUser(api *plugintest.API, userID, locale string) {
+	api.On("GetUser", userID).Return(&model.User{Id: userID, Locale: locale}, nil).Maybe()
+}
+
+// withChannel makes GetChannel return a channel of type typ.
+func withChannel(api *plugintest.API, channelID string, typ model.ChannelType) {
+	api.On("GetChannel", channelID).Return(&model.Channel{Id: channelID, Type: typ}, nil).Maybe()
+}
+
+// recordPosts makes CreatePost succeed and returns the posts it was given.
+func recordPosts(api *plugintest.API) func() []*model.Post {
+	var mu sync.Mutex
+	var posts []*model.Post
+	api.On("CreatePost", mock.Anything).Return(func(post *model.Post) (*model.Post, *model.AppError) {
+		mu.Lock()
+		defer mu.Unlock()
+		post.Id = model.NewId()
+		posts = append(posts, post)
+		return post, nil
+	}).Maybe()
+	return func() []*model.Post {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*model.Post(nil), posts...)
+	}
+}
+
+// waitForWork waits for everything submitted to p's workers to finish.
+func waitForWork(t *testing.T, p *Plugin) {
+	t.Helper()
+	if wp := p.workers.Load(); wp != nil {
+		require.True(t, wp.drain(5*time.Second), "background work didn't finish")
+	}
+}
+
+// memKV is an in-memory plugin KV store behind the mock API.
+type memKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (kv *memKV) register(api *plugintest.API) {
+	api.On("KVGet", mock.Anything).Return(func(key string) ([]byte, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		return kv.data[key], nil
+	}).Maybe()
+	api.On("KVSet", mock.Anything, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.set(key, value)
+		return nil
+	}).Maybe()
+	api.On("KVDelete", mock.Anything).Return(func(key string) *model.AppError {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		delete(kv.data, key)
+		return nil
+	}).Maybe()
+	api.On("KVCompareAndSet", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, old, value []byte) (bool, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if !bytes.Equal(kv.data[key], old) {
+			return false, nil
+		}
+		kv.set(key, value)
+		return true, nil
+	}).Maybe()
+	api.On("KVCompareAndDelete", mock.Anything, mock.Anything).Return(func(key string, old []byte) (bool, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if !bytes.Equal(kv.data[key], old) {
+			return false, nil
+		}
+		delete(kv.data, key)
+		return true, nil
+	}).Maybe()
+	api.On("KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything).Return(func(key string, value []byte, opts model.PluginKVSetOptions) (bool, *model.AppError) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if opts.Atomic && !bytes.Equal(kv.data[key], opts.OldValue) {
+			return false, nil
+		}
+		kv.set(key, value)
+		return true, nil
+	}).Maybe()
+}
+
+func (kv *memKV) set(key string, value []byte) {
+	if value == nil {
+		delete(kv.data, key)
+		return
+	}
+	kv.data[key] = value
+}
+
+// ---- lookupOdesli ----
+
+func TestLookupOdesli(t *testing.T) {
+	t.Run("happy path", func(t *testing.T) {
+		cfg := &Config{}
+		var gotURL string
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			gotURL = r.URL.Query().Get("url")
+			assert.Equal(t, "/links", r.URL.Path)
+			serveFixture(t, "song")(w, r)
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, err := p.lookupOdesli("https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", "")
+		require.NoError(t, err)
+		assert.Equal(t, "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", gotURL)
+		assert.Equal(t, "Daft Punk — One More Time", att.Title)
+		assert.Equal(t, "https://song.link/s/0DiWol3AO6WpXZgp0goxAV", att.TitleLink)
+		assert.Contains(t, att.Text, "[Spotify](https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV)")
+		assert.NotEmpty(t, att.ThumbURL)
+	})
+
+	t.Run("non-200", func(t *testing.T) {
+		cfg := &Config{}
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "not found", http.StatusNotFound)
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, err := p.lookupOdesli("https://open.spotify.com/track/unknown", "")
+		assert.Nil(t, att)
+		var statusErr *odesliStatusError
+		require.True(t, errors.As(err, &statusErr), "got %v", err)
+		assert.Equal(t, http.StatusNotFound, statusErr.Code)
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		cfg := &Config{}
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"entityUniqueId": "SPOTIFY_SONG::1", "pageUrl": `))
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, err := p.lookupOdesli("https://open.spotify.com/track/1", "")
+		assert.Nil(t, att)
+		assert.Error(t, err)
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		cfg := &Config{}
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, err := p.lookupOdesli("https://open.spotify.com/track/1", "")
+		assert.Nil(t, att)
+		assert.Error(t, err)
+	})
+
+	t.Run("sends the country", func(t *testing.T) {
+		cfg := &Config{}
+		var gotCountry string
+		newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+			gotCountry = r.URL.Query().Get("userCountry")
+			serveFixture(t, "song")(w, r)
+		})
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		_, _, err := p.lookupOdesli("https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", "DE")
+		require.NoError(t, err)
+		assert.Equal(t, "DE", gotCountry)
+	})
+}
+
+func TestUserCountryConfig(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		warned   bool
+	}{
+		{"DE", "DE", false},
+		{" de ", "DE", false},
+		{"uk", "GB", false},
+		{"", "", false},
+		{"DEU", "", true},
+		{"zz", "", true},
+		{"not a country", "", true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			cfg := &Config{UserCountry: tc.in}
+			var gotCountry string
+			sent := false
+			song := serveFixture(t, "song")
+			newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				gotCountry, sent = r.URL.Query().Get("userCountry"), r.URL.Query().Has("userCountry")
+				song(w, r)
+			})
+			api := newTestAPI(t)
+			p := newTestPlugin(t, api, cfg)
+
+			assert.Equal(t, tc.want, p.config().country())
+			_, _, err := p.lookupOdesli("https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", p.config().country())
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, gotCountry)
+			assert.Equal(t, tc.want != "", sent)
+
+			if tc.warned {
+				api.AssertCalled(t, "LogWarn", "invalid country code, ignoring", "country", strings.TrimSpace(tc.in))
+			} else {
+				api.AssertNotCalled(t, "LogWarn", "invalid country code, ignoring", "country", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestConcurrentLookupsShareOneRequest(t *testing.T) {
+	const link, n = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", 10
+	cfg := &Config{}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	song := serveFixture(t, "song")
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		song(w, r)
+	})
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+	var releaseOnce sync.Once
+	done := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(done) // before the server closes, even if the test fails
+
+	var wg sync.WaitGroup
+	titles := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if att, _, err := p.lookupOdesli(link, ""); err == nil {
+				titles[i] = att.Title
+			}
+		}()
+	}
+	// Hold the one request until every lookup has missed the cache.
+	require.Eventually(t, func() bool { return p.metrics.cacheMisses.Load() == n }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	done()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, requests)
+	for _, title := range titles {
+		assert.Equal(t, "Daft Punk — One More Time", title)
+	}
+}
+
+func TestRetryOnEmpty(t *testing.T) {
+	defer func(d time.Duration) { emptyRetryDelay = d }(emptyRetryDelay)
+	emptyRetryDelay = 10 * time.Millisecond
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	empty := []byte(`{"entityUniqueId": "SPOTIFY_SONG::0DiWol3AO6WpXZgp0goxAV", "entitiesByUniqueId": {}, "linksByPlatform": {}}`)
+
+	// serve answers with bodies in turn, repeating the last, and counts calls.
+	serve := func(bodies ...[]byte) (http.HandlerFunc, *int) {
+		var mu sync.Mutex
+		calls := 0
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			body := bodies[min(calls, len(bodies)-1)]
+			calls++
+			mu.Unlock()
+			_, _ = w.Write(body)
+		}, &calls
+	}
+
+	t.Run("empty then complete", func(t *testing.T) {
+		cfg := &Config{RetryOnEmpty: true}
+		handler, calls := serve(empty, readFixture(t, "song"))
+		newOdesliServer(t, cfg, handler)
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, err := p.lookupOdesli(link, "")
+		require.NoError(t, err)
+		assert.Equal(t, "Daft Punk — One More Time", att.Title)
+		assert.Equal(t, 2, *calls)
+	})
+
+	t.Run("retries only once", func(t *testing.T) {
+		cfg := &Config{RetryOnEmpty: true}
+		handler, calls := serve(empty)
+		newOdesliServer(t, cfg, handler)
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, _ := p.lookupOdesli(link, "")
+		assert.Nil(t, att)
+		assert.Equal(t, 2, *calls)
+
+		// Not cached, so the next share asks again.
+		_, _, _ = p.lookupOdesli(link, "")
+		assert.Equal(t, 4, *calls)
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		cfg := &Config{}
+		handler, calls := serve(empty, readFixture(t, "song"))
+		newOdesliServer(t, cfg, handler)
+		p := newTestPlugin(t, newTestAPI(t), cfg)
+
+		att, _, _ := p.lookupOdesli(link, "")
+		assert.Nil(t, att)
+		assert.Equal(t, 1, *calls)
+	})
+}
+
+// ---- cleanMusicURL ----
+
+func TestCleanMusicURL(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"unchanged", "https://open.spotify.com/track/abc", "https://open.spotify.com/track/abc"},
+		{"surrounding space", "  https://open.spotify.com/track/abc\n", "https://open.spotify.com/track/abc"},
+		{"angle brackets", "<https://open.spotify.com/track/abc>", "https://open.spotify.com/track/abc"},
+		{"trailing period", "https://open.spotify.com/track/abc.", "https://open.spotify.com/track/abc"},
+		{"trailing comma", "https://open.spotify.com/track/abc,", "https://open.spotify.com/track/abc"},
+		{"closing paren of the sentence", "https://open.spotify.com/track/abc)", "https://open.spotify.com/track/abc"},
+		{"several punctuation marks", "https://open.spotify.com/track/abc).", "https://open.spotify.com/track/abc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cleanMusicURL(tc.in))
+		})
+	}
+}
+
+func TestCleanMusicURLBrackets(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"wikipedia style", "https://en.wikipedia.org/wiki/One_More_Time_(Daft_Punk_song)", "https://en.wikipedia.org/wiki/One_More_Time_(Daft_Punk_song)"},
+		{"wikipedia style closing a sentence's paren", "https://en.wikipedia.org/wiki/One_More_Time_(Daft_Punk_song))", "https://en.wikipedia.org/wiki/One_More_Time_(Daft_Punk_song)"},
+		{"remix in the path then a period", "https://artist.bandcamp.com/track/song-(remix).", "https://artist.bandcamp.com/track/song-(remix)"},
+		{"encoded parentheses", "https://soundcloud.com/artist/song-%28remix%29", "https://soundcloud.com/artist/song-%28remix%29"},
+		{"encoded then a closing paren of the sentence", "https://soundcloud.com/artist/song-%28remix%29)", "https://soundcloud.com/artist/song-%28remix%29"},
+		{"square brackets in the path", "https://example.com/song[live]", "https://example.com/song[live]"},
+		{"closing square bracket of the text", "https://open.spotify.com/track/abc]", "https://open.spotify.com/track/abc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cleanMusicURL(tc.in))
+		})
+	}
+}
+
+func TestCleanMusicURLQueryParams(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"spotify share id dropped", "https://open.spotify.com/track/abc?si=123&utm_source=copy-link", "https://open.spotify.com/track/abc"},
+		{"apple track id kept", "https://music.apple.com/us/album/_/697194953?i=697195787&uo=4", "https://music.apple.com/us/album/_/697194953?i=697195787"},
+		{"youtube video, playlist and time kept", "https://www.youtube.com/watch?v=FGBhQbmPwH8&list=PL1&t=42&feature=share&si=x", "https://www.youtube.com/watch?list=PL1&t=42&v=FGBhQbmPwH8"},
+		{"youtu.be time kept", "https://youtu.be/FGBhQbmPwH8?si=x&t=42", "https://youtu.be/FGBhQbmPwH8?t=42"},
+		{"bandcamp subdomain", "https://artist.bandcamp.com/track/song?from=embed", "https://artist.bandcamp.com/track/song"},
+		{"unknown host keeps other params", "https://example.com/song?id=1&utm_medium=social&fbclid=z", "https://example.com/song?id=1"},
+		{"unknown host without tracking untouched", "https://example.com/song?b=2&a=1", "https://example.com/song?b=2&a=1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cleanMusicURL(tc.in))
+		})
+	}
+}
+
+func TestNormalizeAppleURL(t *testing.T) {
+	const want = "https://music.apple.com/us/album/one-more-time/697194953?i=697195787"
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"canonical", want, want},
+		{"geo host", "https://geo.music.apple.com/us/album/one-more-time/697194953?i=697195787&ls=1", want},
+		{"itunes host", "https://itunes.apple.com/us/album/one-more-time/id697194953?i=697195787&uo=4", want},
+		{"locale noise", "https://music.apple.com/us/album/one-more-time/697194953?i=697195787&l=en-GB&app=music#top", want},
+		{"http and casing", "http://Music.Apple.com/us/album/one-more-time/697194953?i=697195787", want},
+		{"album without a track", "https://itunes.apple.com/gb/album/discovery/id697194953", "https://music.apple.com/gb/album/discovery/697194953"},
+		{"other hosts untouched", "https://apple.com/music/id123", "https://apple.com/music/id123"},
+		{"spotify untouched", "https://open.spotify.com/track/id123", "https://open.spotify.com/track/id123"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cleanMusicURL(tc.in))
+		})
+	}
+}
+
+func TestIDNHosts(t *testing.T) {
+	// Unicode hosts are sent on in punycode; ASCII hosts are left alone.
+	assert.Equal(t, "https://xn--bcher-kva.example/song", cleanMusicURL("https://bücher.example/song"))
+	assert.Equal(t, "https://xn--bcher-kva.example/song", cleanMusicURL("https://xn--bcher-kva.example/song"))
+	assert.Equal(t, "https://open.spotify.com/track/abc", cleanMusicURL("https://OPEN.spotify.com/track/abc"))
+	// Fullwidth letters fold to the ASCII host.
+	assert.Equal(t, "https://open.spotify.com/track/abc", cleanMusicURL("https://ｏｐｅｎ.spotify.com/track/abc"))
+
+	cfg := &Config{extraMusicHosts: parseHostList("bücher.example")}
+	for _, raw := range []string{"https://bücher.example/song", "https://xn--bcher-kva.example/song", "https://shop.BÜCHER.example/song"} {
+		assert.True(t, cfg.isMusicURL(raw), raw)
+	}
+	// A lookalike isn't the allowlisted host.
+	assert.False(t, cfg.isMusicURL("https://bucher.example/song"))
+	assert.True(t, cfg.isMusicURL("https://ｏｐｅｎ.spotify.com/track/abc"))
+}
+
+func TestCleanMusicURLTrackingParams(t *testing.T) {
+	for _, tc := range []struct {
+		platform, in, want string
+	}{
+		{"spotify", "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV?si=abc123", "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"},
+		{"apple music", "https://music.apple.com/us/album/one-more-time/697194953?i=697195787&ls=1&app=music", "https://music.apple.com/us/album/one-more-time/697194953?i=697195787"},
+		{"youtube", "https://www.youtube.com/watch?v=FGBhQbmPwH8&feature=youtu.be&utm_source=x", "https://www.youtube.com/watch?v=FGBhQbmPwH8"},
+		{"youtube music", "https://music.youtube.com/watch?v=FGBhQbmPwH8&si=abc", "https://music.youtube.com/watch?v=FGBhQbmPwH8"},
+		{"youtube playlist", "https://music.youtube.com/playlist?list=OLAK5uy_k&si=abc", "https://music.youtube.com/playlist?list=OLAK5uy_k"},
+		{"tidal", "https://tidal.com/browse/track/1234567?u", "https://tidal.com/browse/track/1234567"},
+		{"deezer", "https://www.deezer.com/track/3135556?utm_campaign=clipboard-generic&utm_source=user_sharing", "https://www.deezer.com/track/3135556"},
+		{"soundcloud", "https://soundcloud.com/daftpunkofficialmusic/one-more-time?utm_medium=text&utm_campaign=social_sharing", "https://soundcloud.com/daftpunkofficialmusic/one-more-time"},
+		{"amazon music", "https://music.amazon.com/albums/B00000000?trackAsin=B00000001&ref=dm_sh_x", "https://music.amazon.com/albums/B00000000?trackAsin=B00000001"},
+		{"instagram share", "https://open.spotify.com/album/2noRn2Aes5aoNVsU6iWThc?igshid=xyz&fbclid=abc", "https://open.spotify.com/album/2noRn2Aes5aoNVsU6iWThc"},
+	} {
+		t.Run(tc.platform, func(t *testing.T) {
+			assert.Equal(t, tc.want, cleanMusicURL(tc.in))
+		})
+	}
+
+	// The same song shared twice hits the same cache entry.
+	assert.Equal(t,
+		cacheKey(cleanMusicURL("https://open.spotify.com/track/abc?si=one"), ""),
+		cacheKey(cleanMusicURL("https://open.spotify.com/track/abc?si=two&utm_source=copy-link"), ""))
+}
+
+// ---- ExecuteCommand ----
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		command string
+		want    commandInput
+	}{
+		{
+			name:    "trigger only",
+			command: "/songlink",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}},
+		},
+		{
+			name:    "url",
+			command: "/songlink https://open.spotify.com/track/abc",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}, URLs: []string{"https://open.spotify.com/track/abc"}},
+		},
+		{
+			name:    "extra whitespace and doubled slash",
+			command: "  //songlink \t  https://open.spotify.com/track/abc   ",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}, URLs: []string{"https://open.spotify.com/track/abc"}},
+		},
+		{
+			name:    "subcommand",
+			command: "/songlink SetCountry de",
+			want:    commandInput{Trigger: "songlink", Subcommand: "setcountry", Flags: map[string]string{}, Words: []string{"de"}},
+		},
+		{
+			name:    "subcommand only right after the trigger",
+			command: "/songlink listen help",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}, Words: []string{"listen", "help"}},
+		},
+		{
+			name:    "flags",
+			command: "/songlink --Private --country=de https://open.spotify.com/track/abc",
+			want: commandInput{
+				Trigger: "songlink",
+				Flags:   map[string]string{"private": "", "country": "de"},
+				URLs:    []string{"https://open.spotify.com/track/abc"},
+			},
+		},
+		{
+			name:    "bare host gets a scheme",
+			command: "/songlink open.spotify.com/track/abc",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}, URLs: []string{"https://open.spotify.com/track/abc"}},
+		},
+		{
+			name:    "lone double dash is a word",
+			command: "/songlink --",
+			want:    commandInput{Trigger: "songlink", Flags: map[string]string{}, Words: []string{"--"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseCommand(tc.command))
+		})
+	}
+}
+
+func TestExecuteCommandUsage(t *testing.T) {
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	p := newTestPlugin(t, api, &Config{})
+
+	for _, command := range []string{"/songlink", "/songlink just words", "/songlink --private"} {
+		resp, appErr := p.ExecuteCommand(nil, &model.CommandArgs{Command: command, UserId: "user1", ChannelId: "channel1"})
+		require.Nil(t, appErr)
+		assert.Equal(t, model.CommandResponseTypeEphemeral, resp.ResponseType)
+		assert.Equal(t, tr("en", "usage", "songlink"), resp.Text, command)
+	}
+
+	resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink help", UserId: "user1"})
+	assert.True(t, strings.HasPrefix(resp.Text, "#### Songlink"))
+}
+
+func TestExecuteCommandRejectsBadArguments(t *testing.T) {
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	p := newTestPlugin(t, api, &Config{})
+
+	many := "/songlink" + strings.Repeat(" https://open.spotify.com/track/abc", maxPreviewURLs+1)
+	resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: many, UserId: "user1", ChannelId: "channel1"})
+	assert.Equal(t, tr("en", "too_many_links", maxPreviewURLs), resp.Text)
+
+	resp, _ = p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink --country=germany https://open.spotify.com/track/abc", UserId: "user1", ChannelId: "channel1"})
+	assert.Equal(t, tr("en", "bad_country_flag"), resp.Text)
+}
+
+func TestExecuteCommandPostPermissions(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, tc := range []struct {
+		name      string
+		cfg       Config
+		flags     string
+		typ       model.ChannelType
+		userPost  bool
+		botPost   bool
+		botJoin   bool
+		want      string
+		wantPosts int
+	}{
+		{name: "user may post", typ: model.ChannelTypeOpen, userPost: true, want: "fetching", wantPosts: 1},
+		{name: "user may not post", typ: model.ChannelTypeOpen, want: "cannot_post"},
+		{name: "private preview needs no permission", flags: "--private ", typ: model.ChannelTypeOpen, want: "fetching"},
+		{name: "bot may post", cfg: Config{PostAsBot: true}, typ: model.ChannelTypePrivate, userPost: true, botPost: true, want: "fetching", wantPosts: 1},
+		{name: "bot may join", cfg: Config{PostAsBot: true}, typ: model.ChannelTypeOpen, userPost: true, botJoin: true, want: "fetching", wantPosts: 1},
+		{name: "bot may not post", cfg: Config{PostAsBot: true}, typ: model.ChannelTypePrivate, userPost: true, want: "bot_cannot_post"},
+		{name: "bot may not join", cfg: Config{PostAsBot: true}, typ: model.ChannelTypeOpen, userPost: true, want: "bot_cannot_post"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			newOdesliServer(t, &cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withUser(api, "user1", "en")
+			withChannel(api, "channel1", tc.typ)
+			api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(tc.userPost).Maybe()
+			api.On("HasPermissionToChannel", testBotID, "channel1", model.PermissionCreatePost).Return(tc.botPost).Maybe()
+			api.On("HasPermissionToTeam", testBotID, mock.Anything, model.PermissionJoinPublicChannels).Return(tc.botJoin).Maybe()
+			api.On("SendEphemeralPost", "user1", mock.Anything).Return(&model.Post{}).Maybe()
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, &cfg)
+
+			resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink " + tc.flags + link, UserId: "user1", ChannelId: "channel1"})
+			waitForWork(t, p)
+
+			assert.Equal(t, tr("en", tc.want), resp.Text)
+			assert.Len(t, posts(), tc.wantPosts)
+		})
+	}
+}
+
+func TestExecuteCommandFindsTheLinkAnywhere(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, tc := range []struct {
+		name, command, wantCaption string
+	}{
+		{"after words", "/songlink check this out " + link, "check this out"},
+		{"between words", "/songlink check this out " + link + " so good", "check this out so good"},
+		{"after flags and words", "/songlink --compact for friday: <" + link + ">", "for friday:"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{}
+			var asked string
+			song := serveFixture(t, "song")
+			newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				asked = r.URL.Query().Get("url")
+				song(w, r)
+			})
+			api := newTestAPI(t)
+			withUser(api, "user1", "en")
+			api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: tc.command, UserId: "user1", ChannelId: "channel1"})
+			waitForWork(t, p)
+
+			assert.Equal(t, tr("en", "fetching"), resp.Text)
+			assert.Equal(t, link, asked)
+			require.Len(t, posts(), 1)
+			assert.Equal(t, tc.wantCaption, posts()[0].Message)
+		})
+	}
+}
+
+func TestExecuteCommandRepliesInThread(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, rootID := range []string{"root1", ""} {
+		t.Run("root "+rootID, func(t *testing.T) {
+			cfg := &Config{}
+			newOdesliServer(t, cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withUser(api, "user1", "en")
+			api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			_, _ = p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink " + link, UserId: "user1", ChannelId: "channel1", RootId: rootID})
+			waitForWork(t, p)
+
+			require.Len(t, posts(), 1)
+			assert.Equal(t, rootID, posts()[0].RootId)
+		})
+	}
+}
+
+func TestCommandTriggerReregistration(t *testing.T) {
+	cfg := &Config{}
+	api := newTestAPI(t)
+	var registered []string
+	api.On("RegisterCommand", mock.Anything).Run(func(args mock.Arguments) {
+		registered = append(registered, args.Get(0).(*model.Command).Trigger)
+	}).Return(nil)
+	api.On("UnregisterCommand", "", "songlink").Return(nil).Once()
+	p := newTestPlugin(t, api, cfg)
+	require.NoError(t, p.registerCommands())
+
+	cfg.CommandTrigger = "/Music"
+	require.NoError(t, p.OnConfigurationChange())
+	assert.Equal(t, []string{"songlink", "music"}, registered)
+	assert.Contains(t, p.config().help("en"), "`/music help` shows this message.")
+
+	// An unchanged trigger is left alone; an invalid one falls back to the
+	// default.
+	require.NoError(t, p.OnConfigurationChange())
+	api.On("UnregisterCommand", "", "music").Return(nil).Once()
+	cfg.CommandTrigger = "two words"
+	require.NoError(t, p.OnConfigurationChange())
+	assert.Equal(t, "songlink", p.config().commandTrigger())
+	assert.Equal(t, []string{"songlink", "music", "songlink"}, registered)
+	api.AssertExpectations(t)
+}
+
+// ---- Configuration ----
+
+func TestFailedConfigLoadKeepsPreviousConfig(t *testing.T) {
+	api := newTestAPI(t)
+	good := Config{AutoUnfurl: true, UserCountry: "de"}
+	api.On("LoadPluginConfiguration", mock.Anything).Run(func(args mock.Arguments) {
+		*args.Get(0).(*Config) = good
+	}).Return(nil).Once()
+	api.On("LoadPluginConfiguration", mock.Anything).Return(errors.New("store unavailable")).Once()
+	p := NewPlugin()
+	p.SetAPI(api)
+	t.Cleanup(func() { _ = p.OnDeactivate() })
+
+	require.NoError(t, p.OnConfigurationChange())
+	before := p.config()
+	require.Error(t, p.OnConfigurationChange())
+	assert.Same(t, before, p.config())
+	assert.True(t, p.config().AutoUnfurl)
+	assert.Equal(t, "DE", p.config().country())
+}
+
+func TestFailedFirstConfigLoad(t *testing.T) {
+	api := newTestAPI(t)
+	api.On("LoadPluginConfiguration", mock.Anything).Return(errors.New("store unavailable"))
+	p := NewPlugin()
+	p.SetAPI(api)
+	t.Cleanup(func() { _ = p.OnDeactivate() })
+
+	// Activation tries once more and refuses to run without a config.
+	require.Error(t, p.OnConfigurationChange())
+	assert.Nil(t, p.config())
+	require.Error(t, p.OnActivate())
+	assert.Nil(t, p.config())
+
+	// Hooks stay quiet rather than act on nothing.
+	post := &model.Post{UserId: "sharer", ChannelId: "channel1", Message: "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"}
+	got, reason := p.MessageWillBePosted(nil, post)
+	assert.Same(t, post, got)
+	assert.Empty(t, reason)
+}
+
+func TestJobsWaitForActivation(t *testing.T) {
+	cfg := &Config{WarmCacheURLs: "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"}
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+	// The server loads the configuration before activating the plugin.
+	assert.Nil(t, p.warmJob)
+	assert.Nil(t, p.digestJob)
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	require.NoError(t, p.OnConfigurationChange())
+	require.NotNil(t, p.warmJob)
+	require.NotNil(t, p.digestJob)
+
+	// Nothing is started again once deactivated.
+	warm, digest := p.warmJob, p.digestJob
+	require.NoError(t, p.OnDeactivate())
+	require.NoError(t, p.OnConfigurationChange())
+	assert.Same(t, warm, p.warmJob)
+	assert.Same(t, digest, p.digestJob)
+}
+
+// ---- Unfurling ----
+
+func TestUnfurlByChannelType(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, tc := range []struct {
+		name       string
+		typ        model.ChannelType
+		mode       string
+		wantAuthor string // "" for no post
+		wantRemove bool
+	}{
+		{"public channel", model.ChannelTypeOpen, "", testBotID, true},
+		{"private channel", model.ChannelTypePrivate, "", testBotID, true},
+		{"DM as the sharer", model.ChannelTypeDirect, "", "sharer", false},
+		{"GM as the sharer", model.ChannelTypeGroup, directUnfurlUser, "sharer", false},
+		{"DM as the bot", model.ChannelTypeDirect, directUnfurlBot, testBotID, true},
+		{"DM off", model.ChannelTypeDirect, directUnfurlOff, "", false},
+		{"public channel with DMs off", model.ChannelTypeOpen, directUnfurlOff, testBotID, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{AutoUnfurl: true, ShowRemoveButton: true, DirectMessageUnfurls: tc.mode}
+			newOdesliServer(t, cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withChannel(api, "channel1", tc.typ)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: "listen " + link})
+			waitForWork(t, p)
+
+			if tc.wantAuthor == "" {
+				assert.Empty(t, posts())
+				return
+			}
+			require.Len(t, posts(), 1)
+			post := posts()[0]
+			assert.Equal(t, tc.wantAuthor, post.UserId)
+			assert.Equal(t, "post1", post.RootId)
+			require.Len(t, post.Attachments(), 1)
+			assert.Equal(t, tc.wantRemove, storedPosterID(post) == "sharer")
+			if tc.wantAuthor != testBotID {
+				// Marked so its links aren't unfurled again.
+				assert.NotNil(t, post.GetProp(previewProp))
+			}
+		})
+	}
+}
+
+func TestBusyChannelDigest(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	for _, tc := range []struct {
+		name       string
+		typ        model.ChannelType
+		wantPosted bool
+	}{
+		// The digest is posted by the bot, so it's only used where the bot
+		// posts unfurls.
+		{"public channel queues for the digest", model.ChannelTypeOpen, false},
+		{"DM unfurls as the sharer", model.ChannelTypeDirect, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{AutoUnfurl: true, DigestThreshold: 1}
+			newOdesliServer(t, cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withChannel(api, "channel1", tc.typ)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link})
+			waitForWork(t, p)
+
+			pending, _ := api.KVGet(digestPendingPrefix + "channel1")
+			if tc.wantPosted {
+				require.Len(t, posts(), 1)
+				assert.Equal(t, "sharer", posts()[0].UserId)
+				assert.Nil(t, pending)
+			} else {
+				assert.Empty(t, posts())
+				assert.Contains(t, string(pending), link)
+			}
+		})
+	}
+}
+
+func TestDigestEscapesTitles(t *testing.T) {
+	cfg := &Config{}
+	body := bytes.ReplaceAll(readFixture(t, "song"), []byte("One More Time"), []byte("One *More* [Time]"))
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write(body) })
+	api := newTestAPI(t)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	p.postDigest("channel1", []pendingLink{{URL: "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"}})
+
+	require.Len(t, posts(), 1)
+	require.Len(t, posts()[0].Attachments(), 1)
+	assert.Equal(t, `• [Daft Punk — One \*More\* \[Time\]](https://song.link/s/0DiWol3AO6WpXZgp0goxAV)`, posts()[0].Attachments()[0].Text)
+}
+
+func TestUnfurlDoesNotHoldUpThePost(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	cfg := &Config{AutoUnfurl: true}
+	release := make(chan struct{})
+	song := serveFixture(t, "song")
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		song(w, r)
+	})
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	post := &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link}
+	got, rejection := p.MessageWillBePosted(nil, post)
+	assert.Same(t, post, got)
+	assert.Empty(t, rejection)
+	assert.Empty(t, posts(), "posted before the lookup finished")
+
+	close(release)
+	waitForWork(t, p)
+	assert.Len(t, posts(), 1)
+}
+
+func TestUnfurlSkippedWhenWorkersBusy(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	cfg := &Config{AutoUnfurl: true, MaxConcurrentLookups: 1}
+	release := make(chan struct{})
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+	require.True(t, p.submit(func() { <-release }))
+
+	p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link})
+	close(release)
+	waitForWork(t, p)
+	assert.Empty(t, posts())
+}
+
+func TestLimitUnfurls(t *testing.T) {
+	urls := []string{"a", "b", "c", "d", "e"}
+	for _, tc := range []struct {
+		name string
+		cfg  *Config
+		want []string
+	}{
+		{"default is every link up to 3", &Config{}, []string{"a", "b", "c"}},
+		{"no config", nil, []string{"a", "b", "c"}},
+		{"all with a cap", &Config{MultiLinkMode: multiLinkAll, MaxUnfurlsPerPost: 4}, []string{"a", "b", "c", "d"}},
+		{"first", &Config{MultiLinkMode: multiLinkFirst, MaxUnfurlsPerPost: 4}, []string{"a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.cfg.limitUnfurls(urls))
+		})
+	}
+	assert.Equal(t, []string{"a"}, (&Config{}).limitUnfurls([]string{"a"}))
+}
+
+func TestMusicURLsScanLimits(t *testing.T) {
+	const music = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	var b strings.Builder
+	for i := range 25 {
+		fmt.Fprintf(&b, "https://example.com/page/%d ", i)
+	}
+	manyLinks := b.String() + music
+
+	for _, tc := range []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{"default stops at 20 links", 0, nil},
+		{"raised limit", 26, []string{music}},
+		{"no limit", -1, []string{music}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPlugin(t, newTestAPI(t), &Config{MaxScannedLinks: tc.limit})
+			assert.Equal(t, tc.want, p.musicURLs(manyLinks))
+		})
+	}
+
+	p := newTestPlugin(t, newTestAPI(t), &Config{MaxScannedLinks: 2})
+	assert.Equal(t, []string{music, "https://open.spotify.com/track/two"},
+		p.musicURLs(music+" https://open.spotify.com/track/two https://open.spotify.com/track/three"))
+
+	// Only the start of a huge paste is searched, and a link straddling the
+	// cut is dropped rather than half-read.
+	p = newTestPlugin(t, newTestAPI(t), &Config{MaxScannedLinks: -1})
+	filler := strings.Repeat("x", maxScannedBytes-len(music)-1)
+	assert.Equal(t, []string{music}, p.musicURLs(music+" "+filler+" https://open.spotify.com/track/two"))
+	assert.Empty(t, p.musicURLs(strings.Repeat("x", maxScannedBytes-10)+" "+music))
+}
+
+func TestMixedLinksOnlySendMusicToOdesli(t *testing.T) {
+	const message = "Review: https://news.example.com/daft-punk-review and the song " +
+		"https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV, also https://music.apple.com/us/album/_/697194953?i=697195787 " +
+		"and https://www.youtube.com/watch?v=unrelated-talk-that-is-not-music"
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{multiLinkAll, []string{"https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV", "https://music.apple.com/us/album/_/697194953?i=697195787", "https://www.youtube.com/watch?v=unrelated-talk-that-is-not-music"}},
+		{multiLinkFirst, []string{"https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			cfg := &Config{AutoUnfurl: true, MultiLinkMode: tc.mode}
+			var mu sync.Mutex
+			var asked []string
+			song := serveFixture(t, "song")
+			newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				asked = append(asked, r.URL.Query().Get("url"))
+				mu.Unlock()
+				song(w, r)
+			})
+			api := newTestAPI(t)
+			withChannel(api, "channel1", model.ChannelTypeOpen)
+			recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: message})
+			waitForWork(t, p)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.ElementsMatch(t, tc.want, asked)
+			for _, u := range asked {
+				assert.NotContains(t, u, "news.example.com")
+			}
+		})
+	}
+}
+
+func TestUnfurlEveryLinkInAPost(t *testing.T) {
+	cfg := &Config{AutoUnfurl: true}
+	song := serveFixture(t, "song")
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Query().Get("url"), "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		song(w, r)
+	})
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	// A repeated link counts once, a failed one doesn't stop the rest, and
+	// the fourth link is past the default cap of 3.
+	message := "new albums: https://open.spotify.com/album/one https://open.spotify.com/album/missing " +
+		"https://open.spotify.com/album/one https://open.spotify.com/album/two https://open.spotify.com/album/three"
+	p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: message})
+	waitForWork(t, p)
+
+	assert.Len(t, posts(), 2)
+	for _, post := range posts() {
+		assert.Equal(t, "post1", post.RootId)
+	}
+}
+
+func TestOwnPostsAreNotUnfurled(t *testing.T) {
+	const link = "https://song.link/s/0DiWol3AO6WpXZgp0goxAV"
+	cfg := &Config{AutoUnfurl: true}
+	requests := 0
+	song := serveFixture(t, "song")
+	newOdesliServer(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		song(w, r)
+	})
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	// The bot's preview text links to the Songlink page.
+	own := &model.Post{Id: "post1", UserId: testBotID, ChannelId: "channel1", Message: "[Open on Songlink](" + link + ")"}
+	p.MessageWillBePosted(nil, own)
+	edited := own.Clone()
+	edited.Message += " https://open.spotify.com/track/4cOdK2wGLETKBW3PvgPWqT"
+	p.MessageWillBeUpdated(nil, edited, own)
+	waitForWork(t, p)
+
+	assert.Empty(t, posts())
+	assert.Zero(t, requests)
+}
+
+// ---- buildAttachment ----
+
+// songAttachment renders the song fixture with cfg.
+func songAttachment(t *testing.T, cfg *Config) *model.SlackAttachment {
+	t.Helper()
+	var o OdesliResult
+	require.NoError(t, json.Unmarshal(readFixture(t, "song"), &o))
+	att := buildAttachment(&o, cfg, "en")
+	require.NotNil(t, att)
+	return att
+}
+
+func TestCompactMode(t *testing.T) {
+	full := songAttachment(t, &Config{CopyAllLinks: true})
+	compact := songAttachment(t, &Config{CopyAllLinks: true, CompactMode: true})
+
+	assert.NotEmpty(t, full.ThumbURL)
+	assert.NotEmpty(t, full.Fields)
+	assert.Empty(t, compact.ThumbURL)
+	assert.Empty(t, compact.Fields)
+	// The linked title and the chips are the same.
+	assert.Equal(t, full.Title, compact.Title)
+	assert.Equal(t, full.TitleLink, compact.TitleLink)
+	assert.Equal(t, full.Text, compact.Text)
+
+	// Spotify details are left out too.
+	track := &spotifyTrack{Popularity: 50, DurationMs: 1000}
+	addSpotifyFields(compact, track, &Config{CompactMode: true}, "en")
+	assert.Empty(t, compact.Fields)
+
+	// --compact trims a card that was built in full.
+	compactAttachment(full)
+	assert.Empty(t, full.ThumbURL)
+	assert.Empty(t, full.Fields)
+}
+
+func TestChipSeparatorAndLabels(t *testing.T) {
+	cfg := &Config{ChipSeparator: " | ", PlatformLabels: "appleMusic=AM, spotify=, =Nothing, youtubeMusic"}
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+
+	att := songAttachment(t, p.config())
+	assert.Equal(t, "[Spotify](https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV) | "+
+		"[iTunes](https://geo.music.apple.com/us/album/_/697194953?i=697195787&app=itunes) | "+
+		"[AM](https://geo.music.apple.com/us/album/_/697194953?i=697195787) | "+
+		"[YouTube Music](https://music.youtube.com/watch?v=FGBhQbmPwH8)", att.Text)
+	// Empty and malformed overrides are ignored.
+	assert.Equal(t, map[string]string{"appleMusic": "AM"}, p.config().labelOverrides)
+
+	t.Run("line breaks", func(t *testing.T) {
+		cfg.ChipSeparator = `\n`
+		require.NoError(t, p.OnConfigurationChange())
+		assert.Equal(t, 3, strings.Count(songAttachment(t, p.config()).Text, "\n"))
+	})
+
+	t.Run("markdown falls back to the default", func(t *testing.T) {
+		cfg.ChipSeparator = " ** "
+		require.NoError(t, p.OnConfigurationChange())
+		assert.Contains(t, songAttachment(t, p.config()).Text, defaultChipSeparator)
+	})
+}
+
+// ---- Edited posts ----
+
+func TestTooOldToUnfurl(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	post := func(age time.Duration) *model.Post { return &model.Post{CreateAt: now.Add(-age).UnixMilli()} }
+	cfg := &Config{MaxUnfurlAgeDays: 7}
+
+	assert.False(t, cfg.tooOldToUnfurl(post(7*24*time.Hour), now), "exactly at the limit")
+	assert.True(t, cfg.tooOldToUnfurl(post(7*24*time.Hour+time.Second), now), "just past the limit")
+	assert.False(t, cfg.tooOldToUnfurl(post(time.Hour), now))
+	assert.False(t, (&Config{}).tooOldToUnfurl(post(365*24*time.Hour), now), "off by default")
+	assert.False(t, cfg.tooOldToUnfurl(&model.Post{}, now), "unknown age")
+}
+
+func TestEditUnfurlsAddedLinks(t *testing.T) {
+	const before = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	const added = "https://open.spotify.com/track/4cOdK2wGLETKBW3PvgPWqT"
+	for _, tc := range []struct {
+		name      string
+		age       time.Duration
+		wantPosts int
+	}{
+		{"recent post", time.Hour, 1},
+		{"old post", 8 * 24 * time.Hour, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{AutoUnfurl: true, MaxUnfurlAgeDays: 7}
+			newOdesliServer(t, cfg, serveFixture(t, "song"))
+			api := newTestAPI(t)
+			withChannel(api, "channel1", model.ChannelTypeOpen)
+			posts := recordPosts(api)
+			p := newTestPlugin(t, api, cfg)
+
+			old := &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: before, CreateAt: time.Now().Add(-tc.age).UnixMilli()}
+			edited := old.Clone()
+			edited.Message = before + " " + added
+			p.MessageWillBeUpdated(nil, edited, old)
+			waitForWork(t, p)
+
+			// Only the added link is previewed, never the one that was there.
+			assert.Len(t, posts(), tc.wantPosts)
+		})
+	}
+}
+
+func TestAttachmentByEntityKind(t *testing.T) {
+	for _, tc := range []struct {
+		fixture, wantTitle, wantAuthor, wantFallback string
+	}{
+		{"song", "Daft Punk — One More Time", "", "Daft Punk — One More Time"},
+		{"album", "Daft Punk — Discovery", "Album", "Album: Daft Punk — Discovery"},
+		// No artist, and no dangling dash.
+		{"empty_artist", "Today's Top Hits", "Playlist", "Playlist: Today's Top Hits"},
+		// The show stands in for the artist, after the title.
+		{"episode", "The Making of Discovery — Song Exploder", "Episode", "Episode: The Making of Discovery — Song Exploder"},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			var o OdesliResult
+			require.NoError(t, json.Unmarshal(readFixture(t, tc.fixture), &o))
+			att := buildAttachment(&o, &Config{}, "en")
+			assert.Equal(t, tc.wantTitle, att.Title)
+			assert.Equal(t, tc.wantAuthor, att.AuthorName)
+			assert.Equal(t, tc.wantFallback, att.Fallback)
+		})
+	}
+
+	for id, want := range map[string]string{
+		"SPOTIFY_SONG::1":      entityTrack,
+		"YOUTUBE_VIDEO::1":     entityTrack,
+		"ITUNES_ALBUM::1":      entityAlbum,
+		"SPOTIFY_PLAYLIST::1":  entityPlaylist,
+		"SPOTIFY_EPISODE::1":   entityEpisode,
+		"SPOTIFY_SHOW::1":      entityPodcast,
+		"SOMETHING_UNKNOWN::1": entityTrack,
+		"no separator at all":  entityTrack,
+	} {
+		assert.Equal(t, want, entityKind(id), id)
+	}
+}
+
+func TestAttachmentWithoutPlatformLinks(t *testing.T) {
+	var o OdesliResult
+	require.NoError(t, json.Unmarshal(readFixture(t, "no_links"), &o))
+
+	att := buildAttachment(&o, &Config{}, "en")
+	require.NotNil(t, att)
+	assert.Equal(t, "Obscure Artist — Rare B-Side", att.Title)
+	assert.Equal(t, "[Open on Songlink](https://song.link/s/7ouMYWpwJ422jRcDASZB7P)", att.Text)
+
+	// With nowhere to link to there's no card at all.
+	o.PageUrl = ""
+	assert.Nil(t, buildAttachment(&o, &Config{}, "en"))
+}
+
+func TestMalformedPlatformLinks(t *testing.T) {
+	var o OdesliResult
+	require.NoError(t, json.Unmarshal(readFixture(t, "malformed_links"), &o))
+
+	att := buildAttachment(&o, &Config{}, "en")
+	require.NotNil(t, att)
+	// Scheme-relative and bare-host links become https; relative ones go.
+	assert.Contains(t, att.Text, "[Spotify](https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV)")
+	assert.Contains(t, att.Text, "[TIDAL](https://tidal.com/browse/track/2188710)")
+	assert.NotContains(t, att.Text, "Deezer")
+	assert.NotContains(t, att.Text, "/track/3135553")
+}
+
+func TestAttachmentLabelsFollowLocale(t *testing.T) {
+	var o OdesliResult
+	require.NoError(t, json.Unmarshal(readFixture(t, "many_platforms"), &o))
+	att := buildAttachment(&o, &Config{CopyAllLinks: true, MaxChips: 3}, "de")
+	assert.Equal(t, "Geteilt von Spotify", att.Footer)
+	require.Len(t, att.Fields, 1)
+	assert.Equal(t, "Alle Links", att.Fields[0].Title)
+	assert.Regexp(t, `\[\+\d+ weitere\]\(https://song\.link/`, att.Text)
+
+	var titleOnly OdesliResult
+	require.NoError(t, json.Unmarshal(readFixture(t, "no_links"), &titleOnly))
+	att = buildAttachment(&titleOnly, &Config{}, "de")
+	assert.Equal(t, "[Auf Songlink öffnen](https://song.link/s/7ouMYWpwJ422jRcDASZB7P)", att.Text)
+}
+
+func TestLookupTitleOnlyKeepsSonglinkChip(t *testing.T) {
+	// Just a title, and the only platform link is unusable.
+	cfg := &Config{}
+	newOdesliServer(t, cfg, serveFixture(t, "title_only"))
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+
+	att, _, err := p.lookupOdesli("https://artist.bandcamp.com/track/untitled-demo", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Untitled Demo", att.Title)
+	assert.Equal(t, "https://song.link/b/a1b2c3", att.TitleLink)
+	assert.Equal(t, "[Open on Songlink](https://song.link/b/a1b2c3)", att.Text)
+	assert.Empty(t, att.ThumbURL)
+}
+
+func TestDegenerateResults(t *testing.T) {
+	for fixture, want := range map[string]bool{
+		"degenerate": true,
+		"song":       false,
+		"no_links":   false, // a title is enough for a card
+		"title_only": false,
+	} {
+		var o OdesliResult
+		require.NoError(t, json.Unmarshal(readFixture(t, fixture), &o))
+		assert.Equal(t, want, isDegenerate(&o), fixture)
+	}
+
+	const link = "https://open.spotify.com/track/3nqQXoyQOWXiESFLlDF1hG"
+	t.Run("command", func(t *testing.T) {
+		cfg := &Config{}
+		newOdesliServer(t, cfg, serveFixture(t, "degenerate"))
+		api := newTestAPI(t)
+		withUser(api, "user1", "en")
+		api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+		var told []string
+		api.On("SendEphemeralPost", "user1", mock.Anything).Run(func(args mock.Arguments) {
+			told = append(told, args.Get(1).(*model.Post).Message)
+		}).Return(&model.Post{})
+		p := newTestPlugin(t, api, cfg)
+
+		p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink " + link, UserId: "user1", ChannelId: "channel1"})
+		waitForWork(t, p)
+
+		// Nothing is posted, and the user hears why.
+		api.AssertNotCalled(t, "CreatePost", mock.Anything)
+		assert.Equal(t, []string{tr("en", "no_details")}, told)
+	})
+
+	t.Run("unfurl", func(t *testing.T) {
+		cfg := &Config{AutoUnfurl: true}
+		newOdesliServer(t, cfg, serveFixture(t, "degenerate"))
+		api := newTestAPI(t)
+		withChannel(api, "channel1", model.ChannelTypeOpen)
+		posts := recordPosts(api)
+		p := newTestPlugin(t, api, cfg)
+
+		p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link})
+		waitForWork(t, p)
+
+		assert.Empty(t, posts())
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Post pacing ----
+//
+// Bulk features (every link in a post, digests, summaries) can create several
+// posts in a burst, and the server may push back with a rate-limit error.
+// Spread bursts out a little and retry rate-limited posts with backoff rather
+// than dropping them.
+
+const (
+	// postBurst posts may go out back to back within postBurstWindow; later
+	// ones are spaced postSpacing apart.
+	postBurst       = 5
+	postBurstWindow = time.Second
+	postSpacing     = 250 * time.Millisecond
+
+	postRetries = 4
+)
+
+// postRetryBackoff is the wait before the first retry, doubling after each
+// one. A variable so tests needn't wait.
+var postRetryBackoff = 500 * time.Millisecond
+
+type postPacer struct {
+	mu     sync.Mutex
+	recent []time.Time // send slots handed out within postBurstWindow
+}
+
+// reserve hands out the next send slot and returns how long to wait for it.
+func (pp *postPacer) reserve(now time.Time) time.Duration {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	kept := pp.recent[:0]
+	for _, t := range pp.recent {
+		if now.Sub(t) < postBurstWindow {
+			kept = append(kept, t)
+		}
+	}
+	pp.recent = kept
+
+	slot := now
+	if len(pp.recent) >= postBurst {
+		if next := pp.recent[len(pp.recent)-1].Add(postSpacing); next.After(now) {
+			slot = next
+		}
+	}
+	pp.recent = append(pp.recent, slot)
+	return slot.Sub(now)
+}
+
+var errPluginStopping = model.NewAppError("createPost", "songlink.plugin_stopping", nil, "plugin is deactivating", http.StatusServiceUnavailable)
+
+// isRateLimited reports whether the server refused a post for sending too
+// many requests.
+func isRateLimited(appErr *model.AppError) bool {
+	if appErr == nil {
+		return false
+	}
+	return appErr.StatusCode == http.StatusTooManyRequests || strings.Contains(appErr.Id, "rate_limit")
+}
+
+// createPost is CreatePost with pacing and retries on rate limiting. Other
+// errors are returned straight away, and nothing is posted once the plugin
+// is deactivating.
+func (p *Plugin) createPost(post *model.Post) (*model.Post, *model.AppError) {
+	ctx := p.context()
+	if d := p.posts.reserve(time.Now()); d > 0 && !sleepContext(ctx, d) {
+		return nil, errPluginStopping
+	}
+	backoff := postRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			return nil, errPluginStopping
+		}
+		created, appErr := p.API.CreatePost(post)
+		if !isRateLimited(appErr) || attempt == postRetries {
+			return created, appErr
+		}
+		p.logDebug("post rate limited, retrying", "channel_id", post.ChannelId, "in", backoff.String())
+		if !sleepContext(ctx, backoff) {
+			return nil, errPluginStopping
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var errRateLimited = model.NewAppError("CreatePost", "api.context.rate_limit.app_error", nil, "", http.StatusTooManyRequests)
+
+func TestPostPacer(t *testing.T) {
+	var pp postPacer
+	now := time.Now()
+	for i := 0; i < postBurst; i++ {
+		assert.Zero(t, pp.reserve(now), "burst post %d", i)
+	}
+	assert.Equal(t, postSpacing, pp.reserve(now))
+	assert.Equal(t, 2*postSpacing, pp.reserve(now))
+	// Once the window has passed, posts go straight out again.
+	assert.Zero(t, pp.reserve(now.Add(postBurstWindow+3*postSpacing)))
+}
+
+func TestCreatePostRetriesRateLimits(t *testing.T) {
+	defer func(d time.Duration) { postRetryBackoff = d }(postRetryBackoff)
+	postRetryBackoff = time.Millisecond
+
+	newPlugin := func(t *testing.T) (*Plugin, *plugintest.API) {
+		api := newTestAPI(t)
+		return newTestPlugin(t, api, &Config{}), api
+	}
+
+	t.Run("succeeds after rate limiting", func(t *testing.T) {
+		p, api := newPlugin(t)
+		api.On("CreatePost", mock.Anything).Return(nil, errRateLimited).Twice()
+		api.On("CreatePost", mock.Anything).Return(&model.Post{Id: "post1"}, nil).Once()
+
+		created, appErr := p.createPost(&model.Post{ChannelId: "channel1"})
+		require.Nil(t, appErr)
+		assert.Equal(t, "post1", created.Id)
+		api.AssertNumberOfCalls(t, "CreatePost", 3)
+	})
+
+	t.Run("gives up eventually", func(t *testing.T) {
+		p, api := newPlugin(t)
+		api.On("CreatePost", mock.Anything).Return(nil, errRateLimited)
+
+		_, appErr := p.createPost(&model.Post{ChannelId: "channel1"})
+		assert.Equal(t, errRateLimited, appErr)
+		api.AssertNumberOfCalls(t, "CreatePost", postRetries+1)
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		p, api := newPlugin(t)
+		forbidden := model.NewAppError("CreatePost", "api.post.create_post.forbidden", nil, "", http.StatusForbidden)
+		api.On("CreatePost", mock.Anything).Return(nil, forbidden)
+
+		_, appErr := p.createPost(&model.Post{ChannelId: "channel1"})
+		assert.Equal(t, forbidden, appErr)
+		api.AssertNumberOfCalls(t, "CreatePost", 1)
+	})
+}
+
+func TestUnfurlSurvivesRateLimits(t *testing.T) {
+	defer func(d time.Duration) { postRetryBackoff = d }(postRetryBackoff)
+	postRetryBackoff = time.Millisecond
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+
+	cfg := &Config{AutoUnfurl: true}
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withChannel(api, "channel1", model.ChannelTypeOpen)
+	api.On("CreatePost", mock.Anything).Return(nil, errRateLimited).Once()
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	p.MessageWillBePosted(nil, &model.Post{Id: "post1", UserId: "sharer", ChannelId: "channel1", Message: link})
+	waitForWork(t, p)
+	assert.Len(t, posts(), 1)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ---- Outbound proxy ----
+//
+// With ProxyURL set, every outbound request (Odesli, Spotify, short links,
+// Bandcamp) goes through that proxy, except to hosts matched by NoProxy.
+// Without it the usual HTTP_PROXY / HTTPS_PROXY / NO_PROXY environment
+// variables apply. Either way, requests for user-supplied URLs never reach
+// private addresses: their host is resolved before it is handed to the
+// proxy, and direct connections are checked as usual. Proxy credentials are
+// never logged.
+
+// parseProxyURL validates ProxyURL: an http, https or socks5 URL with a host.
+func parseProxyURL(raw string) (*url.URL, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, true
+	}
+	return nil, false
+}
+
+// proxyURL is ProxyURL with ProxyUsername and ProxyPassword added, or nil
+// when no proxy is configured.
+func (c *Config) proxyURL() *url.URL {
+	if c == nil || c.ProxyURL == "" {
+		return nil
+	}
+	u, ok := parseProxyURL(c.ProxyURL)
+	if !ok {
+		return nil
+	}
+	if c.ProxyUsername != "" {
+		u.User = url.UserPassword(c.ProxyUsername, c.ProxyPassword)
+	}
+	return u
+}
+
+// sameProxy reports whether c and other route requests the same way.
+func (c *Config) sameProxy(other *Config) bool {
+	return c.ProxyURL == other.ProxyURL && c.ProxyUsername == other.ProxyUsername &&
+		c.ProxyPassword == other.ProxyPassword && c.NoProxy == other.NoProxy
+}
+
+// proxyConfig is where requests are proxied: ProxyURL for every scheme, or
+// the proxy environment variables as they are now.
+func (c *Config) proxyConfig() *httpproxy.Config {
+	proxy := c.proxyURL()
+	if proxy == nil {
+		return httpproxy.FromEnvironment()
+	}
+	return &httpproxy.Config{
+		HTTPProxy:  proxy.String(),
+		HTTPSProxy: proxy.String(),
+		NoProxy:    c.NoProxy,
+	}
+}
+
+// newTransport is the transport for requests to Odesli and Spotify.
+func newTransport(c *Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	forURL := c.proxyConfig().ProxyFunc()
+	t.Proxy = func(r *http.Request) (*url.URL, error) { return forURL(r.URL) }
+	return t
+}
+
+// newPublicTransport is newTransport restricted to public addresses, for
+// requests to user-supplied URLs.
+func newPublicTransport(c *Config) *http.Transport {
+	t := newTransport(c)
+	restricted := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnlyControl}
+	t.DialContext = restricted.DialContext
+	proxies := proxyAddrs(c.proxyConfig())
+	if len(proxies) == 0 {
+		return t
+	}
+
+	// The proxy itself is usually on a private address; let only it
+	// through unchecked.
+	direct := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies[addr] {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return restricted.DialContext(ctx, network, addr)
+	}
+	viaProxy := t.Proxy
+	t.Proxy = func(r *http.Request) (*url.URL, error) {
+		u, err := viaProxy(r)
+		if u == nil || err != nil {
+			return u, err
+		}
+		// The proxy connects for us, so check the target first.
+		if err := checkResolvesPublic(r.Context(), r.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	return t
+}
+
+// proxyAddrs is the host:port of each proxy in cfg.
+func proxyAddrs(cfg *httpproxy.Config) map[string]bool {
+	addrs := map[string]bool{}
+	for _, raw := range []string{cfg.HTTPProxy, cfg.HTTPSProxy} {
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "://") {
+			// As in the environment, a bare host:port is an HTTP proxy.
+			raw = "http://" + raw
+		}
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			addrs[hostPort(u)] = true
+		}
+	}
+	return addrs
+}
+
+// hostPort is u's host and port, with the scheme's default port.
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkResolvesPublic refuses hosts that are, or resolve to, non-public
+// addresses. A name that doesn't resolve here is left to the proxy.
+func checkResolvesPublic(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !isPublicAddr(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !isPublicAddr(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProxy is a forward proxy on a loopback address that answers every
+// request itself and records the targets it was asked for.
+func newTestProxy(t *testing.T) (*httptest.Server, *[]string) {
+	var targets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.URL.String())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &targets
+}
+
+func TestPublicTransportThroughProxy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  func(proxy string) *Config
+	}{
+		{"ProxyURL", func(proxy string) *Config { return &Config{ProxyURL: proxy} }},
+		{"environment", func(proxy string) *Config {
+			t.Setenv("HTTP_PROXY", proxy)
+			t.Setenv("HTTPS_PROXY", proxy)
+			t.Setenv("NO_PROXY", "")
+			return nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy, targets := newTestProxy(t)
+			client := &http.Client{Transport: newPublicTransport(tc.cfg(proxy.URL))}
+
+			// The proxy is on a private address but is let through.
+			res, err := client.Get("http://songlink-test.invalid/track/1")
+			require.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, []string{"http://songlink-test.invalid/track/1"}, *targets)
+
+			// Private targets are refused before reaching the proxy.
+			for _, raw := range []string{"http://10.0.0.1/x", "http://169.254.169.254/latest/meta-data/"} {
+				_, err := client.Get(raw)
+				assert.ErrorIs(t, err, errPrivateAddress, raw)
+			}
+			assert.Len(t, *targets, 1)
+		})
+	}
+}
+
+func TestProxyAddrs(t *testing.T) {
+	env := (&Config{}).proxyConfig()
+	env.HTTPProxy, env.HTTPSProxy = "proxy.internal:3128", "https://secure.internal"
+	assert.Equal(t, map[string]bool{"proxy.internal:3128": true, "secure.internal:443": true}, proxyAddrs(env))
+
+	cfg := (&Config{ProxyURL: "socks5://10.0.0.9"}).proxyConfig()
+	assert.Equal(t, map[string]bool{"10.0.0.9:1080": true}, proxyAddrs(cfg))
+}
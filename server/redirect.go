@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ---- Short link expansion ----
+//
+// Odesli handles some short links (spotify.link, page.link, …) poorly. With
+// FollowRedirects on, those are expanded to their target before lookup.
+
+// maxRedirects bounds how many hops a short link may take.
+const maxRedirects = 3
+
+// shortLinkHosts only ever redirect to the real music page.
+var shortLinkHosts = map[string]bool{
+	"spotify.link":      true,
+	"spotify.app.link":  true,
+	"deezer.page.link":  true,
+	"link.deezer.com":   true,
+	"on.soundcloud.com": true,
+}
+
+// needsExpanding reports whether musicURL should be followed before lookup:
+// known short links, and admin-added hosts we know nothing about.
+func (c *Config) needsExpanding(musicURL string) bool {
+	if c == nil || !c.FollowRedirects {
+		return false
+	}
+	u, err := url.Parse(musicURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(asciiHost(u.Hostname()), "www.")
+	if shortLinkHosts[host] {
+		return true
+	}
+	_, known := allowedParamsForHost(host)
+	return !known
+}
+
+// expandURL follows up to maxRedirects redirects from musicURL and returns
+// the cleaned final URL. Any failure, loop or non-http(s) target returns the
+// last good URL, so lookup can still try.
+func (p *Plugin) expandURL(ctx context.Context, musicURL string) string {
+	ctx, cancel := context.WithTimeout(ctx, p.config().requestTimeout())
+	defer cancel()
+
+	client := p.publicClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	current := musicURL
+	seen := map[string]bool{current: true}
+	for i := 0; i < maxRedirects; i++ {
+		next, ok := p.nextHop(ctx, client, current)
+		if !ok || seen[next] {
+			break
+		}
+		seen[next] = true
+		current = next
+	}
+	if current == musicURL {
+		return musicURL
+	}
+	return cleanMusicURL(current)
+}
+
+// nextHop asks for target and returns where it redirects to, if anywhere.
+func (p *Plugin) nextHop(ctx context.Context, client *http.Client, target string) (string, bool) {
+	res, err := p.hop(ctx, client, http.MethodHead, target)
+	if err == nil && res.StatusCode == http.StatusMethodNotAllowed {
+		// Some shorteners only answer GET.
+		res, err = p.hop(ctx, client, http.MethodGet, target)
+	}
+	if errors.Is(err, errPrivateAddress) {
+		p.logWarn("short link points at a private address, not following", "url", target)
+		return "", false
+	}
+	if err != nil {
+		p.logDebug("short link expansion stopped", "err", err.Error())
+		return "", false
+	}
+	if res.StatusCode < 300 || res.StatusCode >= 400 {
+		return "", false
+	}
+	loc, err := res.Location()
+	if err != nil || (loc.Scheme != "http" && loc.Scheme != "https") || loc.Host == "" {
+		return "", false
+	}
+	return loc.String(), true
+}
+
+func (p *Plugin) hop(ctx context.Context, client *http.Client, method, target string) (*http.Response, error) {
+	if err := checkPublicURL(target); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mattermost-Songlink-Plugin/0.1")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	return res, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- "Remove preview" button ----
+
+const (
+	removeActionID = "remove"
+	removeRoute    = "/plugins/" + pluginID + "/api/v1/remove"
+)
+
+// removeAction lets posterID, whose link was unfurled, delete the preview.
+// The request a click sends can be forged, so handleRemove reads posterID
+// back from the stored post rather than from the request.
+func removeAction(posterID, locale string) *model.PostAction {
+	return &model.PostAction{
+		Id:    removeActionID,
+		Name:  tr(locale, "remove_button"),
+		Type:  model.PostActionTypeButton,
+		Style: "default",
+		Integration: &model.PostActionIntegration{
+			URL:     removeRoute,
+			Context: map[string]any{"poster_id": posterID},
+		},
+	}
+}
+
+// handleRemove deletes a bot preview for its original poster or a channel
+// admin.
+func (p *Plugin) handleRemove(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid action request")
+		return
+	}
+	if req.UserId != userID {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	post, appErr := p.API.GetPost(req.PostId)
+	if appErr != nil {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	// Only ever delete our own previews, whatever the context says.
+	if post.UserId != p.ensureBot() {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	if _, appErr := p.API.GetChannelMember(post.ChannelId, userID); appErr != nil {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	posterID := storedPosterID(post)
+	if (posterID == "" || userID != posterID) && !p.canManageChannel(userID, post.ChannelId) {
+		writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{
+			EphemeralText: tr(p.userLocale(userID), "remove_forbidden"),
+		})
+		return
+	}
+	if appErr := p.API.DeletePost(post.Id); appErr != nil {
+		p.logWarn("failed to delete preview", "post_id", post.Id, "err", appErr.Error())
+		writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{EphemeralText: tr(p.userLocale(userID), "remove_failed")})
+		return
+	}
+	writeJSON(w, http.StatusOK, model.PostActionIntegrationResponse{})
+}
+
+// storedPosterID is the poster_id in post's own Remove button, or "" if it
+// has none.
+func storedPosterID(post *model.Post) string {
+	for _, att := range post.Attachments() {
+		for _, action := range att.Actions {
+			if action == nil || action.Id != removeActionID || action.Integration == nil {
+				continue
+			}
+			if id, ok := action.Integration.Context["poster_id"].(string); ok {
+				return id
+			}
+		}
+	}
+	return ""
+}
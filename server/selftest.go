@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- /songlink test ----
+
+// sampleTrackURL is a long-lived track every Odesli deployment knows.
+const sampleTrackURL = "https://open.spotify.com/track/4cOdK2wGLETKBW3PvgPWqT"
+
+// executeTest handles "/songlink test [url]": a live lookup that bypasses the
+// cache and posts nothing, reporting what happened to the admin.
+func (p *Plugin) executeTest(userID string, in commandInput) *model.CommandResponse {
+	if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		return p.textResponse(tr(p.userLocale(userID), "test_forbidden"))
+	}
+	target := sampleTrackURL
+	if len(in.URLs) > 0 {
+		target = in.URLs[0]
+	}
+	country := p.config().country()
+
+	ctx, cancel := p.lookupContext()
+	defer cancel()
+	start := time.Now()
+	// Always ask Odesli, even while the circuit breaker is open.
+	client := p.odesliClient()
+	client.Breaker = nil
+	o, err := client.Resolve(ctx, target, country)
+	latency := time.Since(start).Round(time.Millisecond)
+
+	apiKey := "not set"
+	if p.config().odesliAPIKey() != "" {
+		apiKey = "set"
+	}
+	countryLabel := country
+	if countryLabel == "" {
+		countryLabel = "(none)"
+	}
+	lines := []string{
+		"#### Songlink connectivity test",
+		fmt.Sprintf("- Base URL: `%s`", p.config().odesliBaseURL()),
+		fmt.Sprintf("- Country: %s", countryLabel),
+		fmt.Sprintf("- API key: %s", apiKey),
+		fmt.Sprintf("- Link: %s", target),
+		fmt.Sprintf("- Latency: %s", latency),
+	}
+
+	var statusErr *odesliStatusError
+	switch {
+	case err == nil:
+		lines = append(lines, "- HTTP status: 200", "- Parsed: yes")
+		if ent, ok := o.EntitiesByUniqueId[o.EntityUniqueId]; ok {
+			name := joinHeading(ent.ArtistName, ent.Title)
+			lines = append(lines, fmt.Sprintf("- Resolved: %s (%d platforms)", name, len(o.LinksByPlatform)))
+		} else {
+			lines = append(lines, "- Resolved: no entity for that link")
+		}
+	case errors.As(err, &statusErr):
+		lines = append(lines, fmt.Sprintf("- HTTP status: %d", statusErr.Code), "- Parsed: no")
+	default:
+		// Either the request never got an answer or the body wasn't valid
+		// JSON; the error says which.
+		lines = append(lines, fmt.Sprintf("- Error: %s", err.Error()))
+	}
+	return p.textResponse(strings.Join(lines, "\n"))
+}
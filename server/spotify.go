@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Spotify enrichment ----
+//
+// Odesli has no popularity/explicit/preview data. When Spotify credentials are
+// configured we fetch those from the Spotify Web API using the client
+// credentials flow. Any failure simply leaves the card as it was.
+
+const (
+	spotifyTokenURL     = "https://accounts.spotify.com/api/token"
+	spotifyTracksURL    = "https://api.spotify.com/v1/tracks/"
+	spotifyTrackTTL     = 24 * time.Hour
+	maxSpotifyTracks    = 1000
+	spotifyTokenLeeway  = time.Minute
+	spotifyFetchTimeout = 5 * time.Second
+)
+
+type spotifyTrack struct {
+	Popularity int    `json:"popularity"`
+	Explicit   bool   `json:"explicit"`
+	PreviewURL string `json:"preview_url"`
+	DurationMs int64  `json:"duration_ms"`
+	Album      struct {
+		Name                 string `json:"name"`
+		ReleaseDate          string `json:"release_date"`
+		ReleaseDatePrecision string `json:"release_date_precision"`
+	} `json:"album"`
+}
+
+// releaseDate parses the album release date, which Spotify gives to day,
+// month or year precision. It returns the zero time when unknown.
+func (t *spotifyTrack) releaseDate() time.Time {
+	layout := "2006-01-02"
+	switch t.Album.ReleaseDatePrecision {
+	case "month":
+		layout = "2006-01"
+	case "year":
+		layout = "2006"
+	}
+	d, err := time.Parse(layout, t.Album.ReleaseDate)
+	if err != nil {
+		return time.Time{}
+	}
+	return d
+}
+
+type spotifyCacheEntry struct {
+	track   spotifyTrack
+	expires time.Time
+}
+
+type spotifyEnricher struct {
+	mu       sync.Mutex
+	clientID string // credentials the token was issued for
+	token    string
+	expires  time.Time
+	tracks   map[string]spotifyCacheEntry
+}
+
+func (c *Config) spotifyEnabled() bool {
+	return c != nil && c.EnableSpotifyEnrichment &&
+		strings.TrimSpace(c.SpotifyClientID) != "" && strings.TrimSpace(c.SpotifyClientSecret) != ""
+}
+
+// spotifyInfo returns Spotify metadata for the resolved track, or nil when
+// enrichment is off or anything goes wrong.
+func (p *Plugin) spotifyInfo(o *OdesliResult) *spotifyTrack {
+	cfg := p.config()
+	if !cfg.spotifyEnabled() {
+		return nil
+	}
+	link, ok := o.LinksByPlatform["spotify"]
+	if !ok {
+		return nil
+	}
+	id := spotifyTrackID(link.Url)
+	if id == "" {
+		return nil
+	}
+
+	track, err := p.spotifyTrack(cfg, id)
+	if err != nil {
+		p.logDebug("spotify enrichment skipped", "err", err.Error())
+		return nil
+	}
+	return track
+}
+
+// addSpotifyFields adds Spotify-only fields to a full-size card, with numbers
+// and dates formatted for locale. Odesli has no album or duration data, so
+// those come from here too and are left out when Spotify doesn't have them.
+func addSpotifyFields(att *model.SlackAttachment, track *spotifyTrack, cfg *Config, locale string) {
+	if track == nil || att == nil || (cfg != nil && cfg.CompactMode) {
+		return
+	}
+	if album := strings.TrimSpace(track.Album.Name); album != "" {
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{Title: "Album", Value: album, Short: true})
+	}
+	if track.DurationMs > 0 {
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{
+			Title: "Duration",
+			Value: formatDuration(time.Duration(track.DurationMs) * time.Millisecond),
+			Short: true,
+		})
+	}
+	if released := track.releaseDate(); !released.IsZero() {
+		value := strconv.Itoa(released.Year())
+		if precision := track.Album.ReleaseDatePrecision; precision != "month" && precision != "year" {
+			value = formatDate(locale, released)
+		}
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{Title: "Released", Value: value, Short: true})
+	}
+	att.Fields = append(att.Fields, &model.SlackAttachmentField{
+		Title: "Popularity",
+		Value: formatNumber(locale, int64(track.Popularity)) + "/100",
+		Short: true,
+	})
+	if track.Explicit {
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{Title: "Explicit", Value: "Yes", Short: true})
+	}
+	if track.PreviewURL != "" {
+		att.Fields = append(att.Fields, &model.SlackAttachmentField{
+			Title: "Preview",
+			Value: fmt.Sprintf("[30s preview](%s)", track.PreviewURL),
+			Short: true,
+		})
+	}
+}
+
+// spotifyTrackID extracts the id from open.spotify.com/track/<id> links.
+func spotifyTrackID(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || !strings.HasSuffix(strings.ToLower(u.Hostname()), "spotify.com") {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "track" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func (p *Plugin) spotifyTrack(cfg *Config, id string) (*spotifyTrack, error) {
+	s := p.spotify
+	s.mu.Lock()
+	if e, ok := s.tracks[id]; ok && time.Now().Before(e.expires) {
+		s.mu.Unlock()
+		return &e.track, nil
+	}
+	s.mu.Unlock()
+
+	token, err := p.spotifyToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(p.context(), spotifyFetchTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, spotifyTracksURL+url.PathEscape(id), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("spotify status %d", res.StatusCode)
+	}
+	var t spotifyTrack
+	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tracks) >= maxSpotifyTracks {
+		// Cheap bound: start over rather than tracking recency.
+		s.tracks = map[string]spotifyCacheEntry{}
+	}
+	s.tracks[id] = spotifyCacheEntry{track: t, expires: time.Now().Add(spotifyTrackTTL)}
+	return &t, nil
+}
+
+func (p *Plugin) spotifyToken(cfg *Config) (string, error) {
+	s := p.spotify
+	clientID := strings.TrimSpace(cfg.SpotifyClientID)
+
+	s.mu.Lock()
+	if s.clientID == clientID && s.token != "" && time.Now().Before(s.expires) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(p.context(), spotifyFetchTimeout)
+	defer cancel()
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, spotifyTokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, strings.TrimSpace(cfg.SpotifyClientSecret))
+	res, err := p.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("spotify token status %d", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("spotify token response has no access_token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientID = clientID
+	s.token = body.AccessToken
+	s.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - spotifyTokenLeeway)
+	return s.token, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddSpotifyFields(t *testing.T) {
+	track := &spotifyTrack{Popularity: 87, Explicit: true, DurationMs: 320357}
+	track.Album.Name = "Discovery"
+	track.Album.ReleaseDate = "2001-03-07"
+	track.Album.ReleaseDatePrecision = "day"
+
+	fields := func(locale string, track *spotifyTrack, cfg *Config) map[string]string {
+		att := &model.SlackAttachment{}
+		addSpotifyFields(att, track, cfg, locale)
+		out := map[string]string{}
+		for _, f := range att.Fields {
+			out[f.Title] = f.Value.(string)
+		}
+		return out
+	}
+
+	assert.Equal(t, map[string]string{
+		"Album":      "Discovery",
+		"Duration":   "5:20",
+		"Released":   "7 Mar 2001",
+		"Popularity": "87/100",
+		"Explicit":   "Yes",
+	}, fields("en", track, &Config{}))
+	assert.Equal(t, "7.3.2001", fields("de", track, &Config{})["Released"])
+
+	track.Album.ReleaseDate = "2001"
+	track.Album.ReleaseDatePrecision = "year"
+	assert.Equal(t, "2001", fields("en", track, &Config{})["Released"])
+
+	track.Album.ReleaseDate = ""
+	assert.NotContains(t, fields("en", track, &Config{}), "Released")
+
+	assert.Empty(t, fields("en", track, &Config{CompactMode: true}))
+}
+
+func TestAddSpotifyFieldsFromFixtures(t *testing.T) {
+	fields := func(t *testing.T, name string) []*model.SlackAttachmentField {
+		raw, err := os.ReadFile(filepath.Join("testdata", "spotify", name+".json"))
+		require.NoError(t, err)
+		var track spotifyTrack
+		require.NoError(t, json.Unmarshal(raw, &track))
+		att := &model.SlackAttachment{}
+		addSpotifyFields(att, &track, &Config{}, "en")
+		return att.Fields
+	}
+
+	assert.Equal(t, []*model.SlackAttachmentField{
+		{Title: "Album", Value: "Discovery", Short: true},
+		{Title: "Duration", Value: "5:20", Short: true},
+		{Title: "Released", Value: "12 Mar 2001", Short: true},
+		{Title: "Popularity", Value: "79/100", Short: true},
+		{Title: "Preview", Value: "[30s preview](https://p.scdn.co/mp3-preview/abc)", Short: true},
+	}, fields(t, "track"))
+
+	// No album name, duration or preview: those fields are left out.
+	assert.Equal(t, []*model.SlackAttachmentField{
+		{Title: "Released", Value: "1997", Short: true},
+		{Title: "Popularity", Value: "3/100", Short: true},
+		{Title: "Explicit", Value: "Yes", Short: true},
+	}, fields(t, "track_partial"))
+}
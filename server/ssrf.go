@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ---- Outbound address checks ----
+//
+// Short-link expansion and the Bandcamp fallback fetch URLs that users
+// posted. Those requests must not reach loopback, private or link-local
+// addresses (including cloud metadata endpoints at 169.254.169.254), whether
+// named directly, via DNS, or via a redirect. The check runs when connecting,
+// so it also covers names that resolve differently later. Odesli itself is
+// admin-configured and is not restricted.
+
+var errPrivateAddress = errors.New("refusing to connect to a private or local address")
+
+// cgnatPrefix is carrier-grade NAT space, not covered by netip's IsPrivate.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddr reports whether ip is a globally routable unicast address.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!ip.IsUnspecified() && !cgnatPrefix.Contains(ip)
+}
+
+// checkPublicURL rejects URLs whose host is obviously local: a non-public IP
+// literal or a localhost name. Other names are checked when dialling.
+func checkPublicURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	// Compare in ASCII form, so a Unicode spelling of localhost is caught.
+	host := strings.TrimSuffix(asciiHost(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddress
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !isPublicAddr(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// publicOnlyControl refuses connections to non-public addresses once DNS has
+// been resolved.
+func publicOnlyControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !isPublicAddr(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// publicTransport is the transport for requests to user-supplied URLs until
+// the configuration has loaded.
+var publicTransport = newPublicTransport(nil)
+
+// publicClient is the plugin's HTTP client, restricted to public addresses.
+func (p *Plugin) publicClient() *http.Client {
+	c := *p.client()
+	c.Transport = publicTransport
+	if t := p.publicTr.Load(); t != nil {
+		c.Transport = t
+	}
+	return &c
+}
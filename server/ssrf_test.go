@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPublicURL(t *testing.T) {
+	for _, raw := range []string{
+		"http://localhost/x",
+		"http://LOCALHOST./x",
+		"http://api.localhost/x",
+		"http://ｌｏｃａｌｈｏｓｔ/x", // fullwidth, maps to localhost
+		"http://127.0.0.1/x",
+		"http://[::1]/x",
+		"http://10.0.0.5/x",
+		"http://169.254.169.254/latest/meta-data",
+		"http://100.64.0.1/x",
+	} {
+		assert.ErrorIs(t, checkPublicURL(raw), errPrivateAddress, raw)
+	}
+	for _, raw := range []string{
+		"https://open.spotify.com/track/abc",
+		"https://bücher.example/x",
+		"https://xn--bcher-kva.example/x",
+		"http://8.8.8.8/x",
+	} {
+		assert.NoError(t, checkPublicURL(raw), raw)
+	}
+}
+
+func TestPublicOnlyControl(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1:80",
+		"[::1]:443",
+		"10.1.2.3:443",
+		"192.168.1.1:80",
+		"169.254.169.254:80", // cloud metadata
+		"[fd00:ec2::254]:80", // AWS metadata over IPv6
+		"[fe80::1]:80",
+		"[::ffff:127.0.0.1]:80",
+		"0.0.0.0:80",
+	} {
+		assert.ErrorIs(t, publicOnlyControl("tcp", addr, nil), errPrivateAddress, addr)
+	}
+	assert.NoError(t, publicOnlyControl("tcp", "8.8.8.8:443", nil))
+	assert.NoError(t, publicOnlyControl("tcp", "[2001:4860:4860::8888]:443", nil))
+}
+
+func TestPublicClientRefusesLocalServers(t *testing.T) {
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	t.Cleanup(srv.Close)
+	p := newTestPlugin(t, newTestAPI(t), &Config{})
+
+	// httptest listens on 127.0.0.1; the dial itself is refused.
+	_, err := p.publicClient().Get(srv.URL)
+	assert.ErrorIs(t, err, errPrivateAddress)
+	assert.False(t, hit)
+}
+
+func TestExpandURLRefusesPrivateTargets(t *testing.T) {
+	api := newTestAPI(t)
+	p := newTestPlugin(t, api, &Config{FollowRedirects: true})
+
+	for _, raw := range []string{
+		"http://127.0.0.1/s/abc",
+		"http://10.0.0.1/s/abc",
+		"http://169.254.169.254/latest/meta-data/",
+	} {
+		assert.Equal(t, raw, p.expandURL(context.Background(), raw))
+		api.AssertCalled(t, "LogWarn", "short link points at a private address, not following", "url", raw)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Synchronous previews ----
+//
+// With SyncPreview on, /songlink waits briefly for the lookup and answers
+// with the preview itself, skipping the "Fetching preview…" step. Slow
+// lookups fall back to posting in the background as usual.
+
+const defaultSyncPreviewMillis = 2000
+
+// syncPreviewWait is how long /songlink waits for a synchronous preview, or
+// 0 when SyncPreview is off.
+func (c *Config) syncPreviewWait() time.Duration {
+	if c == nil || !c.SyncPreview {
+		return 0
+	}
+	if c.SyncPreviewMillis <= 0 {
+		return defaultSyncPreviewMillis * time.Millisecond
+	}
+	return time.Duration(c.SyncPreviewMillis) * time.Millisecond
+}
+
+// syncPreview runs req's lookup on the pool and waits up to wait for it. In
+// time, the preview comes back as the command response; otherwise the lookup
+// carries on and posts by itself. ok is false when the pool is full.
+func (p *Plugin) syncPreview(req previewRequest, wait time.Duration, locale string) (resp *model.CommandResponse, ok bool) {
+	// Whoever flips claimed first decides: the waiter (timed out, the
+	// worker posts) or the worker (done, the waiter responds).
+	var claimed atomic.Bool
+	done := make(chan previewResult, 1)
+	ok = p.submit(func() {
+		res := p.lookupPreview(req)
+		if claimed.CompareAndSwap(false, true) {
+			done <- res
+			return
+		}
+		p.deliverPreview(req, res)
+	})
+	if !ok {
+		return nil, false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return p.previewResponse(req, res, locale), true
+	case <-timer.C:
+		if claimed.CompareAndSwap(false, true) {
+			return p.textResponse(tr(locale, "fetching")), true
+		}
+		// The worker finished just as we gave up; it's handing over now.
+		return p.previewResponse(req, <-done, locale), true
+	}
+}
+
+// previewResponse finishes the command with a completed lookup: the cards
+// are posted right away, like a background preview but without the
+// ConfirmPosted note, or the user is told why there are none.
+func (p *Plugin) previewResponse(req previewRequest, res previewResult, locale string) *model.CommandResponse {
+	if len(res.atts) == 0 {
+		return p.textResponse(p.failureMessage(locale, res.err))
+	}
+	// Posted here rather than as an in-channel response, so clients get
+	// preview_posted with the post's id.
+	if created := p.createPreviewPost(req, p.previewMessage(req, res), res.atts, locale); created != nil {
+		p.publishPreviewPosted(created, res.tracks)
+	}
+	return &model.CommandResponse{}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncPreviewPublishesPreviewPosted(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	cfg := &Config{SyncPreview: true, SyncPreviewMillis: 5000, ConfirmPosted: true}
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+
+	resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink listen " + link, UserId: "user1", ChannelId: "channel1"})
+
+	// Posted by the time the command answers, so nothing else to show.
+	require.Len(t, posts(), 1)
+	assert.Empty(t, resp.Text)
+	post := posts()[0]
+	assert.Equal(t, "user1", post.UserId)
+	assert.Equal(t, "listen", post.Message)
+	assert.NotNil(t, post.GetProp(previewProp))
+	api.AssertCalled(t, "PublishWebSocketEvent", previewPostedEvent, mock.MatchedBy(func(data map[string]any) bool {
+		return data["post_id"] == post.Id && data["title"] == "One More Time"
+	}), &model.WebsocketBroadcast{ChannelId: "channel1"})
+	// The user saw it land; no confirmation needed.
+	api.AssertNotCalled(t, "SendEphemeralPost", mock.Anything, mock.Anything)
+}
+
+func TestSyncPreviewFailureIsTheResponse(t *testing.T) {
+	cfg := &Config{SyncPreview: true, SyncPreviewMillis: 5000}
+	newOdesliServer(t, cfg, serveFixture(t, "degenerate"))
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true)
+	p := newTestPlugin(t, api, cfg)
+
+	resp, _ := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink https://open.spotify.com/track/3nqQXoyQOWXiESFLlDF1hG", UserId: "user1", ChannelId: "channel1"})
+	assert.Equal(t, tr("en", "no_details"), resp.Text)
+	api.AssertNotCalled(t, "CreatePost", mock.Anything)
+}
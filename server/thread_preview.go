@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- /songlink thread ----
+//
+// "/songlink thread", run from a thread's reply box, collects the music links
+// shared in that thread and previews them together in one post, like a
+// /songlink with several links.
+
+// maxThreadScanPosts bounds how many of a thread's most recent posts are
+// searched for links.
+const maxThreadScanPosts = 200
+
+// threadMusicURLs returns the music links shared in args' thread, oldest
+// first and at most maxPreviewURLs, or a response explaining why there are
+// none. Songlink's own previews are skipped.
+func (p *Plugin) threadMusicURLs(args *model.CommandArgs, locale string) ([]string, *model.CommandResponse) {
+	if args.RootId == "" {
+		return nil, p.textResponse(tr(locale, "thread_usage", p.config().commandTrigger()))
+	}
+	list, appErr := p.API.GetPostThread(args.RootId)
+	if appErr != nil {
+		p.API.LogError("failed to load thread", "root_id", args.RootId, "err", appErr.Error())
+		return nil, p.textResponse(tr(locale, "thread_failed"))
+	}
+	posts := make([]*model.Post, 0, len(list.Posts))
+	for _, post := range list.Posts {
+		if post.ChannelId != args.ChannelId {
+			// Only threads in the channel the command was run in.
+			return nil, p.textResponse(tr(locale, "thread_failed"))
+		}
+		if post.DeleteAt == 0 && !p.isOwnPost(post) && post.GetProp(previewProp) == nil {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].CreateAt < posts[j].CreateAt })
+	if len(posts) > maxThreadScanPosts {
+		posts = posts[len(posts)-maxThreadScanPosts:]
+	}
+
+	var urls []string
+	seen := map[string]bool{}
+	for _, post := range posts {
+		for _, u := range p.postMusicURLs(post) {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		return nil, p.textResponse(tr(locale, "thread_no_links"))
+	}
+	if len(urls) > maxPreviewURLs {
+		urls = urls[:maxPreviewURLs]
+	}
+	return urls, nil
+}
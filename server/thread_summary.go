@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// ---- Thread playlist summary ----
+
+const (
+	threadPlaylistKeyPrefix = "thread_playlist_"
+	// maxThreadTracks bounds what we remember per thread in KV.
+	maxThreadTracks = 100
+	// maxSummaryTracks bounds how many tracks the summary card lists.
+	maxSummaryTracks = 25
+)
+
+// threadTrack is one shared track remembered for a thread's playlist summary.
+type threadTrack struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type threadPlaylist struct {
+	Tracks        []threadTrack `json:"tracks"`
+	SummaryPosted bool          `json:"summary_posted"`
+	// Dropped counts tracks that arrived after maxThreadTracks was hit.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// recordThreadTrack remembers an unfurled track for its thread and posts the
+// summary once the configured link count is reached.
+func (p *Plugin) recordThreadTrack(channelID, rootID string, att *model.SlackAttachment) {
+	if p.config() == nil || !p.config().EnableThreadSummary || rootID == "" || att == nil {
+		return
+	}
+	track := threadTrack{Title: att.Title, URL: att.TitleLink}
+	if track.URL == "" {
+		return
+	}
+
+	var postNow bool
+	pl, err := kvUpdateJSON(p.API, threadPlaylistKeyPrefix+rootID, func(pl *threadPlaylist) bool {
+		postNow = false
+		if pl.contains(track.URL) {
+			return false
+		}
+		if len(pl.Tracks) < maxThreadTracks {
+			pl.Tracks = append(pl.Tracks, track)
+		} else {
+			pl.Dropped++
+		}
+		threshold := p.config().ThreadSummaryThreshold
+		if threshold > 0 && !pl.SummaryPosted && len(pl.Tracks) >= threshold {
+			pl.SummaryPosted = true
+			postNow = true
+		}
+		return true
+	})
+	if err != nil {
+		p.logWarn("failed to save thread playlist", "err", err.Error())
+		return
+	}
+	if postNow {
+		p.postThreadSummary(channelID, rootID, pl)
+	}
+}
+
+// ReactionHasBeenAdded treats the configured emoji on a thread root as
+// "this thread is resolved" and posts the playlist summary.
+func (p *Plugin) ReactionHasBeenAdded(ctx *plugin.Context, reaction *model.Reaction) {
+	if p.config() == nil || !p.config().EnableThreadSummary || reaction == nil {
+		return
+	}
+	emoji := strings.Trim(strings.TrimSpace(p.config().ThreadSummaryEmoji), ":")
+	if emoji == "" || reaction.EmojiName != emoji {
+		return
+	}
+
+	pl, err := kvUpdateJSON(p.API, threadPlaylistKeyPrefix+reaction.PostId, func(pl *threadPlaylist) bool {
+		if len(pl.Tracks) == 0 || pl.SummaryPosted {
+			return false
+		}
+		pl.SummaryPosted = true
+		return true
+	})
+	if err != nil {
+		p.logWarn("failed to save thread playlist", "err", err.Error())
+		return
+	}
+	if len(pl.Tracks) == 0 {
+		return
+	}
+	p.postThreadSummary(reaction.ChannelId, reaction.PostId, pl)
+}
+
+func (p *Plugin) postThreadSummary(channelID, rootID string, pl *threadPlaylist) {
+	summary := &model.Post{
+		ChannelId: channelID,
+		RootId:    rootID,
+		Props: map[string]any{
+			"attachments": []*model.SlackAttachment{buildThreadSummary(pl, p.serverLocale())},
+		},
+	}
+	if _, err := p.createBotPost(summary); err != nil {
+		p.logWarn("failed to post thread summary", "err", err.Error())
+	}
+}
+
+func buildThreadSummary(pl *threadPlaylist, locale string) *model.SlackAttachment {
+	var lines []string
+	for i, t := range pl.Tracks {
+		if i == maxSummaryTracks {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. [%s](%s)", i+1, escapeLinkText(t.Title), t.URL))
+	}
+	if more := len(pl.Tracks) - len(lines) + pl.Dropped; more > 0 {
+		lines = append(lines, tr(locale, "thread_summary_more", more))
+	}
+	return &model.SlackAttachment{
+		Fallback: tr(locale, "thread_summary_fallback", len(pl.Tracks)+pl.Dropped),
+		Title:    tr(locale, "thread_summary_title"),
+		Text:     strings.Join(lines, "\n"),
+	}
+}
+
+func (pl *threadPlaylist) contains(url string) bool {
+	for _, t := range pl.Tracks {
+		if t.URL == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildThreadSummary(t *testing.T) {
+	pl := &threadPlaylist{
+		Tracks: []threadTrack{
+			{Title: "Daft Punk — One More Time", URL: "https://song.link/s/1"},
+			{Title: "Tame Impala — Let It Happen [Edit]", URL: "https://song.link/s/2"},
+		},
+		Dropped: 1,
+	}
+	att := buildThreadSummary(pl, "en")
+	assert.Equal(t, "Thread playlist", att.Title)
+	assert.Equal(t, "Thread playlist (3 tracks)", att.Fallback)
+	assert.Equal(t, "1. [Daft Punk — One More Time](https://song.link/s/1)\n"+
+		`2. [Tame Impala — Let It Happen \[Edit\]](https://song.link/s/2)`+"\n"+
+		"…and 1 more", att.Text)
+
+	de := buildThreadSummary(pl, "de")
+	assert.Equal(t, "Thread-Playlist", de.Title)
+	assert.True(t, strings.HasSuffix(de.Text, "…und 1 weitere"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Repeat unfurl suppression ----
+//
+// A hot track gets pasted again and again in busy channels. Once a link has
+// been unfurled in a channel, further pastes within UnfurlDedupMinutes are
+// left alone. The marker is a KV entry that expires by itself, set
+// atomically so cluster nodes agree on who unfurls. /songlink is never
+// suppressed.
+
+const (
+	unfurlSeenKeyPrefix       = "unfurl_seen_"
+	defaultUnfurlDedupMinutes = 10
+)
+
+// unfurlDedupWindow is UnfurlDedupMinutes, defaulting to 10. A negative
+// value turns suppression off.
+func (c *Config) unfurlDedupWindow() time.Duration {
+	if c == nil || c.UnfurlDedupMinutes == 0 {
+		return defaultUnfurlDedupMinutes * time.Minute
+	}
+	return time.Duration(c.UnfurlDedupMinutes) * time.Minute
+}
+
+// unfurlSeenKey hashes the channel and link to keep the key short.
+func unfurlSeenKey(channelID, musicURL string) string {
+	sum := sha256.Sum256([]byte(channelID + "\n" + musicURL))
+	return unfurlSeenKeyPrefix + hex.EncodeToString(sum[:16])
+}
+
+// claimUnfurl reports whether musicURL should be unfurled in channelID, i.e.
+// it wasn't already within the window, and marks it as unfurled. If the KV
+// store fails the link is unfurled anyway.
+func (p *Plugin) claimUnfurl(channelID, musicURL string) bool {
+	window := p.config().unfurlDedupWindow()
+	if window <= 0 {
+		return true
+	}
+	ok, appErr := p.API.KVSetWithOptions(unfurlSeenKey(channelID, musicURL), []byte{1}, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(window / time.Second),
+	})
+	if appErr != nil {
+		p.logWarn("failed to check for a recent unfurl", "channel_id", channelID, "err", appErr.Error())
+		return true
+	}
+	return ok
+}
+
+// releaseUnfurl drops the marker after an unfurl that didn't get posted, so
+// the next paste tries again.
+func (p *Plugin) releaseUnfurl(channelID, musicURL string) {
+	if p.config().unfurlDedupWindow() <= 0 {
+		return
+	}
+	if appErr := p.API.KVDelete(unfurlSeenKey(channelID, musicURL)); appErr != nil {
+		p.logWarn("failed to clear unfurl marker", "channel_id", channelID, "err", appErr.Error())
+	}
+}
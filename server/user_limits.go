@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ---- Per-user command rate limit ----
+//
+// Each /songlink invocation starts a background lookup, so a user looping the
+// command would fan out unbounded Odesli requests. A token bucket per user
+// allows short bursts but caps the sustained rate.
+
+const (
+	defaultCommandsPerMinute = 10
+	// maxLimitedUsers bounds the tracked buckets; full buckets are dropped
+	// first since they carry no state worth keeping.
+	maxLimitedUsers = 10000
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type userLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newUserLimiter() *userLimiter {
+	return &userLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// allow takes a token from userID's bucket, which holds perMinute tokens and
+// refills at perMinute per minute. It reports false when the bucket is empty.
+func (l *userLimiter) allow(userID string, perMinute int, now time.Time) bool {
+	capacity := float64(perMinute)
+	rate := capacity / time.Minute.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[userID]
+	if !ok {
+		if len(l.buckets) >= maxLimitedUsers {
+			l.pruneFull(capacity, rate, now)
+		}
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[userID] = b
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneFull forgets buckets that have refilled completely. Callers hold mu.
+func (l *userLimiter) pruneFull(capacity, rate float64, now time.Time) {
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// commandsPerMinute is CommandsPerMinute, defaulting to 10. A negative value
+// turns the limit off.
+func (c *Config) commandsPerMinute() int {
+	if c == nil || c.CommandsPerMinute == 0 {
+		return defaultCommandsPerMinute
+	}
+	return c.CommandsPerMinute
+}
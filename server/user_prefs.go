@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Per-user preferences ----
+
+const (
+	userPrefsKeyPrefix = "user_prefs_"
+
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+type userPrefs struct {
+	// Visibility is the default for /songlink previews; empty means public.
+	Visibility string `json:"visibility,omitempty"`
+	// Country overrides UserCountry for this user's lookups.
+	Country string `json:"country,omitempty"`
+}
+
+// userPrefs loads userID's preferences. A read failure yields the defaults.
+func (p *Plugin) userPrefs(userID string) userPrefs {
+	prefs, err := kvUpdateJSON(p.API, userPrefsKeyPrefix+userID, func(*userPrefs) bool { return false })
+	if err != nil {
+		p.logWarn("failed to load user preferences", "user_id", userID, "err", err.Error())
+		return userPrefs{}
+	}
+	// Older versions stored any two letters as given, e.g. "UK".
+	prefs.Country, _ = normalizeCountry(prefs.Country)
+	return *prefs
+}
+
+func (p *Plugin) updateUserPrefs(userID string, fn func(prefs *userPrefs)) error {
+	_, err := kvUpdateJSON(p.API, userPrefsKeyPrefix+userID, func(prefs *userPrefs) bool {
+		fn(prefs)
+		return true
+	})
+	return err
+}
+
+// visibility picks how this invocation's preview is shown: --private (or
+// --preview, or the preview subcommand) and --public win over the stored
+// default. If both are given, private wins.
+func (in commandInput) visibility(stored string) string {
+	switch {
+	case in.HasFlag(visibilityPrivate), in.HasFlag("preview"), in.Subcommand == "preview":
+		return visibilityPrivate
+	case in.HasFlag(visibilityPublic):
+		return visibilityPublic
+	case stored == visibilityPrivate:
+		return visibilityPrivate
+	default:
+		return visibilityPublic
+	}
+}
+
+// executeVisibility handles "/songlink visibility [public|private]".
+func (p *Plugin) executeVisibility(userID string, in commandInput) *model.CommandResponse {
+	locale := p.userLocale(userID)
+	if len(in.Words) == 0 {
+		current := in.visibility(p.userPrefs(userID).Visibility)
+		return p.textResponse(tr(locale, "visibility_status_"+current, p.config().commandTrigger()))
+	}
+	choice := strings.ToLower(in.Words[0])
+	if choice != visibilityPublic && choice != visibilityPrivate {
+		return p.textResponse(tr(locale, "visibility_usage", p.config().commandTrigger()))
+	}
+	if err := p.updateUserPrefs(userID, func(prefs *userPrefs) { prefs.Visibility = choice }); err != nil {
+		p.API.LogError("failed to save user preferences", "user_id", userID, "err", err.Error())
+		return p.textResponse(tr(locale, "save_failed"))
+	}
+	return p.textResponse(tr(locale, "visibility_"+choice))
+}
+
+// userCountry is userID's stored country, falling back to UserCountry.
+func (p *Plugin) userCountry(userID string) string {
+	if c := p.userPrefs(userID).Country; c != "" {
+		return c
+	}
+	return p.config().country()
+}
+
+// executeSetCountry handles "/songlink setcountry XX|clear".
+func (p *Plugin) executeSetCountry(userID string, in commandInput) *model.CommandResponse {
+	locale := p.userLocale(userID)
+	usage := tr(locale, "country_usage", p.config().commandTrigger())
+	if len(in.Words) == 0 {
+		if c := p.userPrefs(userID).Country; c != "" {
+			return p.textResponse(tr(locale, "country_status", c, usage))
+		}
+		return p.textResponse(usage)
+	}
+	code := ""
+	if !strings.EqualFold(in.Words[0], "clear") {
+		var ok bool
+		if code, ok = normalizeCountry(in.Words[0]); !ok {
+			return p.textResponse(usage)
+		}
+	}
+	if err := p.updateUserPrefs(userID, func(prefs *userPrefs) { prefs.Country = code }); err != nil {
+		p.API.LogError("failed to save user preferences", "user_id", userID, "err", err.Error())
+		return p.textResponse(tr(locale, "save_failed"))
+	}
+	if code == "" {
+		return p.textResponse(tr(locale, "country_cleared"))
+	}
+	return p.textResponse(tr(locale, "country_set", code))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetCountryStoresCanonicalCode(t *testing.T) {
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	p := newTestPlugin(t, api, &Config{})
+	setCountry := func(words ...string) string {
+		return p.executeSetCountry("user1", commandInput{Words: words}).Text
+	}
+
+	assert.Equal(t, tr("en", "country_set", "GB"), setCountry("uk"))
+	assert.Equal(t, "GB", p.userPrefs("user1").Country)
+
+	assert.Equal(t, tr("en", "country_usage", "songlink"), setCountry("ZZ"))
+	assert.Equal(t, "GB", p.userPrefs("user1").Country)
+
+	assert.Equal(t, tr("en", "country_cleared"), setCountry("Clear"))
+	assert.Empty(t, p.userPrefs("user1").Country)
+}
+
+func TestStoredCountryIsNormalized(t *testing.T) {
+	api := newTestAPI(t)
+	p := newTestPlugin(t, api, &Config{})
+	for stored, want := range map[string]string{"UK": "GB", "ZZ": "", "DE": "DE"} {
+		assert.NoError(t, p.updateUserPrefs("user1", func(prefs *userPrefs) { prefs.Country = stored }))
+		assert.Equal(t, want, p.userPrefs("user1").Country, stored)
+	}
+}
+
+func TestVisibilityPrecedence(t *testing.T) {
+	in := func(sub string, flags ...string) commandInput {
+		f := map[string]string{}
+		for _, name := range flags {
+			f[name] = ""
+		}
+		return commandInput{Subcommand: sub, Flags: f}
+	}
+	for _, tc := range []struct {
+		name   string
+		in     commandInput
+		stored string
+		want   string
+	}{
+		{"nothing stored", in(""), "", visibilityPublic},
+		{"stored private", in(""), visibilityPrivate, visibilityPrivate},
+		{"stored public", in(""), visibilityPublic, visibilityPublic},
+		{"--public beats stored private", in("", "public"), visibilityPrivate, visibilityPublic},
+		{"--private beats stored public", in("", "private"), visibilityPublic, visibilityPrivate},
+		{"--preview", in("", "preview"), visibilityPublic, visibilityPrivate},
+		{"preview subcommand", in("preview"), visibilityPublic, visibilityPrivate},
+		{"both flags: private wins", in("", "public", "private"), "", visibilityPrivate},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.in.visibility(tc.stored))
+		})
+	}
+}
+
+func TestExecuteVisibility(t *testing.T) {
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	p := newTestPlugin(t, api, &Config{})
+	run := func(words ...string) string {
+		return p.executeVisibility("user1", commandInput{Words: words}).Text
+	}
+
+	assert.Equal(t, tr("en", "visibility_status_public", "songlink"), run())
+	assert.Equal(t, tr("en", "visibility_private"), run("Private"))
+	assert.Equal(t, visibilityPrivate, p.userPrefs("user1").Visibility)
+	assert.Equal(t, tr("en", "visibility_status_private", "songlink"), run())
+	assert.Equal(t, tr("en", "visibility_usage", "songlink"), run("secret"))
+	assert.Equal(t, visibilityPrivate, p.userPrefs("user1").Visibility)
+}
+
+func TestStoredPrivateDefaultApplies(t *testing.T) {
+	const link = "https://open.spotify.com/track/0DiWol3AO6WpXZgp0goxAV"
+	cfg := &Config{}
+	newOdesliServer(t, cfg, serveFixture(t, "song"))
+	api := newTestAPI(t)
+	withUser(api, "user1", "en")
+	api.On("HasPermissionToChannel", "user1", "channel1", model.PermissionCreatePost).Return(true).Maybe()
+	var ephemeral []*model.Post
+	api.On("SendEphemeralPost", "user1", mock.Anything).Run(func(args mock.Arguments) {
+		ephemeral = append(ephemeral, args.Get(1).(*model.Post))
+	}).Return(&model.Post{})
+	posts := recordPosts(api)
+	p := newTestPlugin(t, api, cfg)
+	require.NoError(t, p.updateUserPrefs("user1", func(prefs *userPrefs) { prefs.Visibility = visibilityPrivate }))
+
+	_, _ = p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink " + link, UserId: "user1", ChannelId: "channel1"})
+	waitForWork(t, p)
+	assert.Empty(t, posts())
+	require.Len(t, ephemeral, 1)
+	atts := ephemeral[0].Attachments()
+	require.NotEmpty(t, atts)
+	assert.Equal(t, shareActionID, atts[len(atts)-1].Actions[0].Id)
+
+	// --public overrides the stored default for this one preview.
+	_, _ = p.ExecuteCommand(nil, &model.CommandArgs{Command: "/songlink --public " + link, UserId: "user1", ChannelId: "channel1"})
+	waitForWork(t, p)
+	assert.Len(t, posts(), 1)
+	assert.Len(t, ephemeral, 1)
+}
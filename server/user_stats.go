@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- Preview stats ----
+//
+// Per-user and instance-wide counts of links looked up for previews, shown
+// by "/songlink stats". Each is one small KV value updated with
+// compare-and-set so concurrent previews don't lose counts.
+
+const (
+	userStatsKeyPrefix = "user_stats_"
+	totalStatsKey      = "stats_total"
+)
+
+type previewStats struct {
+	// Lookups counts the links looked up; Successes those that got a card.
+	Lookups   int64 `json:"lookups"`
+	Successes int64 `json:"successes"`
+}
+
+// recordPreviewStats adds one preview's outcome to userID's and the
+// instance's counters. Failures are logged and otherwise ignored.
+func (p *Plugin) recordPreviewStats(userID string, lookups, successes int) {
+	if lookups == 0 || userID == "" {
+		return
+	}
+	for _, key := range []string{userStatsKeyPrefix + userID, totalStatsKey} {
+		_, err := kvUpdateJSON(p.API, key, func(s *previewStats) bool {
+			s.Lookups += int64(lookups)
+			s.Successes += int64(successes)
+			return true
+		})
+		if err != nil {
+			p.logWarn("failed to update preview stats", "key", key, "err", err.Error())
+		}
+	}
+}
+
+func (p *Plugin) previewStats(key string) (previewStats, error) {
+	s, err := kvUpdateJSON(p.API, key, func(*previewStats) bool { return false })
+	if err != nil {
+		return previewStats{}, err
+	}
+	return *s, nil
+}
+
+// executeStats handles "/songlink stats [--all]": the user's own counts, or
+// with --all the instance's (system admins).
+func (p *Plugin) executeStats(userID string, in commandInput) *model.CommandResponse {
+	locale := p.userLocale(userID)
+	key, id := userStatsKeyPrefix+userID, "stats_user"
+	if in.HasFlag("all") {
+		if !p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+			return p.textResponse(tr(locale, "stats_forbidden"))
+		}
+		key, id = totalStatsKey, "stats_total"
+	}
+	s, err := p.previewStats(key)
+	if err != nil {
+		p.API.LogError("failed to load preview stats", "key", key, "err", err.Error())
+		return p.textResponse(tr(locale, "stats_failed"))
+	}
+	return p.textResponse(tr(locale, id, s.Lookups, s.Successes))
+}
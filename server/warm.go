@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+)
+
+// ---- Cache warming ----
+//
+// Admins can list links that are shared all the time ("song of the day").
+// A cluster-wide job re-resolves them before their cache entries expire and
+// hands the result to every node, so previews for them are always instant.
+
+const (
+	warmJobKey          = "cache_warm"
+	warmClusterEventID  = "cache_warm"
+	minWarmInterval     = 5 * time.Minute
+	defaultWarmInterval = 45 * time.Minute
+)
+
+type warmEvent struct {
+	Key  string        `json:"key"`
+	Resp *OdesliResult `json:"resp"`
+}
+
+// scheduleCacheWarming (re)starts the warm job to match the current config.
+// It is a no-op until the plugin has activated.
+func (p *Plugin) scheduleCacheWarming() {
+	if !p.active() {
+		// OnActivate schedules it once the plugin is running.
+		return
+	}
+	if p.warmJob != nil {
+		if err := p.warmJob.Close(); err != nil {
+			p.logWarn("failed to stop cache warm job", "err", err.Error())
+		}
+		p.warmJob = nil
+	}
+	if len(p.config().warmURLs()) == 0 {
+		return
+	}
+
+	job, err := cluster.Schedule(p.API, warmJobKey, cluster.MakeWaitForInterval(p.config().warmInterval()), p.warmCache)
+	if err != nil {
+		p.API.LogError("failed to schedule cache warm job", "err", err.Error())
+		return
+	}
+	p.warmJob = job
+}
+
+func (p *Plugin) warmCache() {
+	cfg := p.config()
+	country := cfg.country()
+	for _, u := range cfg.warmURLs() {
+		resp, err := p.odesliClient().Resolve(p.context(), u, country)
+		if err != nil {
+			p.logWarn("cache warm lookup failed", "url", u, "err", err.Error())
+			continue
+		}
+		if len(resp.EntitiesByUniqueId) == 0 {
+			continue
+		}
+		key := cacheKey(u, country)
+		p.cache.set(key, resp, p.config().cacheTTLDefault())
+
+		data, err := json.Marshal(warmEvent{Key: key, Resp: resp})
+		if err != nil {
+			continue
+		}
+		if err := p.API.PublishPluginClusterEvent(
+			model.PluginClusterEvent{Id: warmClusterEventID, Data: data},
+			model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeBestEffort},
+		); err != nil {
+			p.logWarn("failed to share warmed cache entry", "err", err.Error())
+		}
+	}
+}
+
+// OnPluginClusterEvent stores entries warmed on another node.
+func (p *Plugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
+	if ev.Id != warmClusterEventID || p.cache == nil {
+		return
+	}
+	var we warmEvent
+	if err := json.Unmarshal(ev.Data, &we); err != nil || we.Resp == nil {
+		return
+	}
+	p.cache.set(we.Key, we.Resp, p.config().cacheTTLDefault())
+}
+
+// warmURLs parses WarmCacheURLs (one per line or comma-separated).
+func (c *Config) warmURLs() []string {
+	if c == nil {
+		return nil
+	}
+	var out []string
+	for _, f := range strings.FieldsFunc(c.WarmCacheURLs, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, cleanMusicURL(f))
+		}
+	}
+	return out
+}
+
+// warmInterval keeps the refresh comfortably inside the cache TTL.
+func (c *Config) warmInterval() time.Duration {
+	d := defaultWarmInterval
+	if c != nil && c.WarmCacheIntervalMinutes > 0 {
+		d = time.Duration(c.WarmCacheIntervalMinutes) * time.Minute
+	}
+	if maxInterval := c.cacheTTLDefault() * 3 / 4; d > maxInterval {
+		d = maxInterval
+	}
+	if d < minWarmInterval {
+		d = minWarmInterval
+	}
+	return d
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// ---- WebSocket events ----
+//
+// The webapp can subscribe to "custom_com.mattermost.songlink_preview_posted"
+// to react when a preview lands in a channel it is showing.
+
+const previewPostedEvent = "preview_posted"
+
+// previewTrack is what the event says about one card, taken from the looked
+// up entity rather than the card, whose heading is formatted for display.
+type previewTrack struct {
+	Title   string
+	Artist  string
+	PageURL string
+	Links   map[string]string // Odesli platform key → URL
+}
+
+// trackFromResult describes the entity o was looked up for.
+func trackFromResult(o *OdesliResult) previewTrack {
+	ent := o.EntitiesByUniqueId[o.EntityUniqueId]
+	t := previewTrack{
+		Title:   strings.TrimSpace(ent.Title),
+		Artist:  strings.TrimSpace(ent.ArtistName),
+		PageURL: o.PageUrl,
+		Links:   map[string]string{},
+	}
+	for k, v := range o.LinksByPlatform {
+		if link, ok := normalizePlatformURL(v.Url); ok {
+			t.Links[k] = link
+		}
+	}
+	return t
+}
+
+// payload is t as plain maps, because the plugin RPC only knows how to
+// encode those.
+func (t previewTrack) payload() map[string]any {
+	links := make(map[string]any, len(t.Links))
+	for k, v := range t.Links {
+		links[k] = v
+	}
+	return map[string]any{"title": t.Title, "artist": t.Artist, "url": t.PageURL, "links": links}
+}
+
+// publishPreviewPosted tells clients viewing post's channel that a preview
+// was posted. title and artist describe the first card; tracks lists all of
+// them.
+func (p *Plugin) publishPreviewPosted(post *model.Post, tracks []previewTrack) {
+	if post == nil || len(tracks) == 0 {
+		return
+	}
+	payloads := make([]any, 0, len(tracks))
+	for _, t := range tracks {
+		payloads = append(payloads, t.payload())
+	}
+	p.API.PublishWebSocketEvent(previewPostedEvent, map[string]any{
+		"post_id":    post.Id,
+		"channel_id": post.ChannelId,
+		"root_id":    post.RootId,
+		"title":      tracks[0].Title,
+		"artist":     tracks[0].Artist,
+		"tracks":     payloads,
+	}, &model.WebsocketBroadcast{ChannelId: post.ChannelId})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackFromResult(t *testing.T) {
+	var o OdesliResult
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"entityUniqueId": "SPOTIFY_EPISODE::1",
+		"pageUrl": "https://song.link/s/1",
+		"entitiesByUniqueId": {"SPOTIFY_EPISODE::1": {"title": " Artist — Title ", "artistName": "The Show"}},
+		"linksByPlatform": {
+			"spotify": {"url": "https://open.spotify.com/episode/1"},
+			"broken": {"url": "/relative"}
+		}
+	}`), &o))
+
+	// The entity's own fields, not re-parsed from the "Episode — Show" heading.
+	assert.Equal(t, previewTrack{
+		Title:   "Artist — Title",
+		Artist:  "The Show",
+		PageURL: "https://song.link/s/1",
+		Links:   map[string]string{"spotify": "https://open.spotify.com/episode/1"},
+	}, trackFromResult(&o))
+}
+
+func TestPublishPreviewPosted(t *testing.T) {
+	api := plugintest.NewAPI(t)
+	var payload map[string]any
+	var broadcast *model.WebsocketBroadcast
+	api.On("PublishWebSocketEvent", previewPostedEvent, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		payload = args.Get(1).(map[string]any)
+		broadcast = args.Get(2).(*model.WebsocketBroadcast)
+	}).Once()
+	p := NewPlugin()
+	p.SetAPI(api)
+
+	p.publishPreviewPosted(&model.Post{Id: "post1", ChannelId: "channel1", RootId: "root1"}, []previewTrack{
+		{Title: "One More Time", Artist: "Daft Punk", PageURL: "https://song.link/s/1", Links: map[string]string{"spotify": "https://open.spotify.com/track/1"}},
+		{Title: "Untitled", PageURL: "https://song.link/s/2", Links: map[string]string{}},
+	})
+
+	assert.Equal(t, "channel1", broadcast.ChannelId)
+	assert.Equal(t, map[string]any{
+		"post_id":    "post1",
+		"channel_id": "channel1",
+		"root_id":    "root1",
+		"title":      "One More Time",
+		"artist":     "Daft Punk",
+		"tracks": []any{
+			map[string]any{"title": "One More Time", "artist": "Daft Punk", "url": "https://song.link/s/1", "links": map[string]any{"spotify": "https://open.spotify.com/track/1"}},
+			map[string]any{"title": "Untitled", "artist": "", "url": "https://song.link/s/2", "links": map[string]any{}},
+		},
+	}, payload)
+
+	// Nothing to say without a post or cards.
+	p.publishPreviewPosted(nil, []previewTrack{{Title: "x"}})
+	p.publishPreviewPosted(&model.Post{Id: "post2"}, nil)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ---- Background work ----
+//
+// Previews are built in the background so the UI clears instantly. A
+// semaphore bounds how many run at once; when it is full, callers tell the
+// user to try again rather than piling up goroutines and Odesli connections.
+
+const (
+	defaultMaxConcurrentLookups = 8
+	// drainTimeout bounds how long OnDeactivate waits for running work.
+	drainTimeout = 5 * time.Second
+)
+
+type workPool struct {
+	sem chan struct{}
+	// wg is shared with the pools this one replaced, so draining also waits
+	// for work still running on them.
+	wg *sync.WaitGroup
+}
+
+func newWorkPool(size int) *workPool {
+	return &workPool{sem: make(chan struct{}, size), wg: &sync.WaitGroup{}}
+}
+
+// resized is a pool of size slots that drains together with wp.
+func (wp *workPool) resized(size int) *workPool {
+	return &workPool{sem: make(chan struct{}, size), wg: wp.wg}
+}
+
+// trySubmit runs fn in the background if a slot is free and reports whether
+// it did.
+func (wp *workPool) trySubmit(fn func()) bool {
+	select {
+	case wp.sem <- struct{}{}:
+	default:
+		return false
+	}
+	wp.wg.Add(1)
+	go func() {
+		defer func() {
+			<-wp.sem
+			wp.wg.Done()
+		}()
+		fn()
+	}()
+	return true
+}
+
+// drain waits up to timeout for work submitted to wp, or to the pools it
+// replaced, to finish.
+func (wp *workPool) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (c *Config) maxConcurrentLookups() int {
+	if c == nil || c.MaxConcurrentLookups <= 0 {
+		return defaultMaxConcurrentLookups
+	}
+	return c.MaxConcurrentLookups
+}
+
+// submit runs fn on the current pool, creating it on first use.
+func (p *Plugin) submit(fn func()) bool {
+	wp := p.workers.Load()
+	if wp == nil {
+		p.workers.CompareAndSwap(nil, newWorkPool(p.config().maxConcurrentLookups()))
+		wp = p.workers.Load()
+	}
+	return wp.trySubmit(fn)
+}
+
+// resizeWorkers swaps in a pool of the configured size. Work already running
+// finishes on the old pool, and OnDeactivate still waits for it.
+func (p *Plugin) resizeWorkers() {
+	size := p.config().maxConcurrentLookups()
+	switch wp := p.workers.Load(); {
+	case wp == nil:
+		p.workers.Store(newWorkPool(size))
+	case cap(wp.sem) != size:
+		p.workers.Store(wp.resized(size))
+	}
+}
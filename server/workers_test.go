@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeWorkersStillDrainsOldWork(t *testing.T) {
+	cfg := &Config{MaxConcurrentLookups: 1}
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+	release := make(chan struct{})
+	require.True(t, p.submit(func() { <-release }))
+	old := p.workers.Load()
+
+	cfg.MaxConcurrentLookups = 4
+	require.NoError(t, p.OnConfigurationChange())
+	wp := p.workers.Load()
+	require.NotSame(t, old, wp)
+	assert.Equal(t, 4, cap(wp.sem))
+	// The new pool has its own slots...
+	assert.True(t, wp.trySubmit(func() {}))
+
+	// ...but draining it waits for the work on the pool it replaced.
+	assert.False(t, wp.drain(50*time.Millisecond))
+	close(release)
+	assert.True(t, wp.drain(time.Second))
+}
+
+func TestResizeWorkersKeepsPoolOfSameSize(t *testing.T) {
+	cfg := &Config{MaxConcurrentLookups: 2}
+	p := newTestPlugin(t, newTestAPI(t), cfg)
+	wp := p.workers.Load()
+	require.NoError(t, p.OnConfigurationChange())
+	assert.Same(t, wp, p.workers.Load())
+}
@@ -0,0 +1,31 @@
+// Songlink webapp bundle. Plain JS, no build step: it only adds the
+// "Create music preview" item to the post menu and calls the server plugin.
+(function () {
+    const pluginId = 'com.mattermost.songlink';
+
+    function csrfToken() {
+        const match = document.cookie.match(/(?:^|;\s*)MMCSRF=([^;]+)/);
+        return match ? match[1] : '';
+    }
+
+    class SonglinkPlugin {
+        initialize(registry, store) {
+            registry.registerPostDropdownMenuAction('Create music preview', (postId) => {
+                // For posts in DMs, which belong to no team.
+                const teamId = store.getState().entities.teams.currentTeamId;
+                fetch(`${window.basename || ''}/plugins/${pluginId}/api/v1/post-action`, {
+                    method: 'POST',
+                    credentials: 'same-origin',
+                    headers: {
+                        'Content-Type': 'application/json',
+                        'X-CSRF-Token': csrfToken(),
+                        'X-Requested-With': 'XMLHttpRequest',
+                    },
+                    body: JSON.stringify({post_id: postId, team_id: teamId}),
+                });
+            });
+        }
+    }
+
+    window.registerPlugin(pluginId, new SonglinkPlugin());
+})();